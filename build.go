@@ -1,34 +1,21 @@
 package urknall
 
 import (
-	"bytes"
 	"fmt"
-	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
-	constants "github.com/megamsys/libgo/utils/obc"
-	"github.com/megamsys/libgo/pairs"
-	"github.com/megamsys/libgo/events"
-	"github.com/megamsys/libgo/events/alerts"
+
+	"github.com/megamsys/urknall/cmd"
 	"github.com/megamsys/urknall/pubsub"
 	"github.com/megamsys/urknall/target"
+	"golang.org/x/net/context"
 )
-const (
-	RUNNING = "running"
-	FINISHED = "finished"
-	STARTING = "starting"
-	COMPLETED = "completed"
-)
-
-	var status constants.Status
-
 
 // A shortcut creating and running a build from the given target and template.
-func Run(target Target, tpl Template,inputs map[string]string) (e error) {
-	return (&Build{
-		Target: target,
-		Template: tpl,
-		Inputs: inputs}).Run()
+// Use megam.Run to have the build's events sent to megam.
+func Run(target Target, tpl Template) (e error) {
+	return (&Build{Target: target, Template: tpl}).Run()
 }
 
 // A shortcut creating and runnign a build from the given target and template
@@ -41,66 +28,154 @@ func DryRun(target Target, tpl Template) (e error) {
 
 // A build is the glue between a target and template.
 type Build struct {
-	Target            // Where to run the build.
-	Template          // What to actually build.
-	Env      []string // Environment variables in the form `KEY=VALUE`.
-	Inputs   map[string]string // Inputs for OBC like email and status
+	Target              // Where to run the build.
+	Template            // What to actually build.
+	Env      []string   // Environment variables in the form `KEY=VALUE`, set for all commands (see Env for task specific ones).
+	Explain  bool       // Add diffs of previous and current scripts for tasks with broken cache to the plan.
+	State    StateStore // Where the cache is kept (on the target's file system if nil).
+
+	CacheDir   string // Directory of the cache on the target (/var/lib/urknall if empty).
+	CacheGroup string // Group owning the cache on the target (urknall if empty).
+	Namespace  string // Separates the cache from those of other projects provisioning the same target (kept in the cache directory's .namespaces directory).
+
+	Retention *RetentionPolicy // If set, the cache is cleaned up after each successful build.
+
+	LockTimeout time.Duration // How long to wait for a build running concurrently on the target (fail immediately if 0).
+	DisableLock bool          // Don't lock the target (the lock requires flock on the target and a state store implementing Locker).
+
+	CommandTimeout time.Duration // Maximum runtime of each command (no limit if 0). See cmd.Timeouter.
+	TaskTimeout    time.Duration // Maximum runtime of each task (no limit if 0).
+
+	MaxParallelTasks int // Maximum number of independent tasks run concurrently (sequentially if 0).
+
+	Escalation         Escalation // How commands gain privileges on the target (sudo for users other than root if empty).
+	EscalationPassword string     // Password sent to sudo on standard input (see EscalationSudoPassword).
+	BecomeUser         string     // User the template's commands are run as (root if empty).
+
+	Retry *cmd.RetryPolicy // Default retry policy of commands (no retries if nil). See cmd.Retrier.
+
+	Facts      *Facts      // Facts of the target (gathered when first used if nil). See Facts.
+	FactsCache *FactsCache // Shares gathered facts between builds.
+
+	// Tasks given by name or pattern (see path.Match, e.g. "nginx.*") are
+	// executed regardless of the cache: all commands of tasks matching
+	// Invalidate or AlwaysRun, and the commands starting at the given index of
+	// tasks matching InvalidateFrom.
+	Invalidate     []string
+	InvalidateFrom map[string]int
+	AlwaysRun      []string
+
+	Notifier Notifier // Receives the build's lifecycle events (none are sent if nil).
+
+	held     *heldLock
+	handlers *handlerState
+	secrets  *secretRegistry // secrets of the rendered template (see AddSecret)
+	name     string          // name of the rendered template (see Event.Template)
 }
 
 // This will render the build's template into a package and run all its tasks.
 func (b *Build) Run() error {
+	return b.RunContext(context.Background())
+}
+
+// Like Run, but the build is aborted if the given context is cancelled or its
+// deadline exceeded. A running command is killed (if the target supports it,
+// see target.Interrupter), marked as failed in the cache and an
+// *InterruptError returned.
+func (b *Build) RunContext(ctx context.Context) error {
+	_, e := b.RunWithResult(ctx)
+	return e
+}
+
+func (b *Build) run(ctx context.Context, res *BuildResult) error {
 	pkg, e := b.prepareBuild()
 	if e != nil {
+		b.notify(EventBuildFailed, "", e)
+		return e
+	}
+	defer b.releaseLock()
+	if b.handlers, e = b.loadHandlers(pkg.tasks, true); e != nil {
+		b.notify(EventBuildFailed, "", e)
 		return e
 	}
+	for _, task := range pkg.tasks {
+		res.Tasks = append(res.Tasks, newTaskResult(task))
+	}
 	m := message(pubsub.MessageTasksProvision, b.hostname(), "")
 	m.Publish("started")
-	templateName := strings.Split(pkg.tasks[0].name,".")[0]
-	status = constants.Status(strings.Join([]string{templateName,RUNNING},"."))
-	_ = eventNotify(b.Inputs,b.hostname())
-	for _, task := range pkg.tasks {
-		if e = b.buildTask(task); e != nil {
-			m.PublishError(e)
-			return e
+	b.notify(EventBuildStarted, "", nil)
+	if e = b.buildTasks(ctx, pkg.tasks, res.Tasks); e != nil {
+		m.PublishError(e)
+		b.notify(EventBuildFailed, "", e)
+		return e
+	}
+	if b.Retention != nil {
+		names := make([]string, 0, len(pkg.tasks))
+		for _, task := range pkg.tasks {
+			names = append(names, task.name)
+		}
+		// The build succeeded, so failing to cleanup is only logged.
+		if _, e := b.cleanup(names, b.Retention); e != nil {
+			logError(e)
 		}
 	}
-	m.Publish(FINISHED)
-	status = constants.Status(strings.Join([]string{templateName,FINISHED},"."))
-	_ = eventNotify(b.Inputs,b.hostname())
+	m.Publish("finished")
+	b.notify(EventBuildFinished, "", nil)
 	return nil
 }
 
 func (b *Build) DryRun() error {
-	pkg, e := b.prepareBuild()
+	plan, e := b.Plan()
 	if e != nil {
 		return e
 	}
 
-	for _, task := range pkg.tasks {
-		for _, command := range task.commands {
-			m := message(pubsub.MessageTasksProvisionTask, b.hostname(), task.name)
-			m.TaskChecksum = command.Checksum()
-			m.Message = command.LogMsg()
+	for _, task := range plan.Tasks {
+		if task.Handler && !task.Triggered {
+			continue
+		}
+		for i, command := range task.Commands {
+			m := message(pubsub.MessageTasksProvisionTask, b.hostname(), task.Name)
+			m.TaskChecksum = command.Checksum
+			m.Message = command.Message
 
 			switch {
-			case command.cached:
+			case command.Cached:
 				m.ExecStatus = pubsub.StatusCached
 				m.Publish("finished")
+			case command.Invalidated:
+				m.ExecStatus = pubsub.StatusInvalidated
+				m.Publish("executed")
 			default:
 				m.ExecStatus = pubsub.StatusExecStart
 				m.Publish("executed")
 			}
+
+			if i == task.CacheBreak && task.Diff != "" {
+				m.Stream = "diff"
+				for _, line := range strings.Split(strings.TrimSuffix(task.Diff, "\n"), "\n") {
+					m.Line = line
+					m.Publish("diff")
+				}
+			}
 		}
 	}
 	return nil
 }
 
-func (build *Build) prepareBuild() (*packageImpl, error) {
-	pkg, e := renderTemplate(build.Template)
+func (build *Build) prepareBuild() (pkg *packageImpl, e error) {
+	pkg, e = build.render()
 	if e != nil {
 		return nil, e
 	}
+	build.name = pkg.name()
+	build.secrets = pkg.secrets
 
+	defer func() {
+		if e != nil {
+			build.releaseLock()
+		}
+	}()
 	if e = build.prepareTarget(); e != nil {
 		return nil, e
 	}
@@ -115,43 +190,32 @@ func (build *Build) prepareBuild() (*packageImpl, error) {
 			return nil, e
 		}
 	}
+	build.publishInvalidations(pkg.tasks)
 
 	return pkg, nil
 }
 
+// render renders the build's template, gathering the target's facts if used.
+func (build *Build) render() (*packageImpl, error) {
+	return renderTemplate(build.Template, &targetFacts{build: build})
+}
+
 func (build *Build) prepareTarget() error {
 	if build.User() == "" {
 		return fmt.Errorf("User not set")
 	}
-	rawCmd := fmt.Sprintf(`{ grep "^%s:" /etc/group | grep %s; } && [ -d %[3]s ] && [ -f %[3]s/.v2 ]`,
-		ukGROUP, build.User(), ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
+	if build.Namespace != "" && !validNamespace.MatchString(build.Namespace) {
+		return fmt.Errorf("invalid namespace %q (only letters, digits, '.', '_' and '-' allowed, not starting with '.')", build.Namespace)
+	}
+	if e := build.validateEscalation(); e != nil {
 		return e
 	}
-	if e := cmd.Run(); e != nil {
-		// If user is missing the group, create group (if necessary), add user and restart ssh connection.
-		cmds := []string{
-			fmt.Sprintf(`{ grep -e '^%[1]s:' /etc/group > /dev/null || { groupadd %[1]s; }; }`, ukGROUP),
-			fmt.Sprintf(`{ [ -d %[1]s ] || { mkdir -p -m 2775 %[1]s && chgrp %[2]s %[1]s; }; }`, ukCACHEDIR, ukGROUP),
-			fmt.Sprintf("usermod -a -G %s %s", ukGROUP, build.User()),
-			fmt.Sprintf(`[ -f %[1]s/.v2 ] || { export DATE=$(date "+%%Y%%m%%d_%%H%%M%%S") && ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.done | tac > %[1]s/$dir/$DATE.run; done && touch %[1]s/.v2;  } `, ukCACHEDIR),
-		}
-
-		cmd, e = build.prepareInternalCommand(strings.Join(cmds, " && "))
-		if e != nil {
-			return e
-		}
-		out := &bytes.Buffer{}
-		err := &bytes.Buffer{}
-		cmd.SetStderr(err)
-		cmd.SetStdout(out)
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf("failed to initiate user %q for provisioning: %s, out=%q err=%q", build.User(), e, out.String(), err.String())
-		}
-		return build.Reset()
+	// Lock before the state store is prepared, so that concurrent builds
+	// don't bootstrap the target at the same time.
+	if e := build.lock(); e != nil {
+		return e
 	}
-	return nil
+	return build.state().Prepare(build)
 }
 
 func (build *Build) prepareTask(tsk *task, ct checksumTree) (e error) {
@@ -159,52 +223,59 @@ func (build *Build) prepareTask(tsk *task, ct checksumTree) (e error) {
 	if cacheKey == "" {
 		return fmt.Errorf("CacheKey must not be empty")
 	}
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
-
 	var found bool
 	var checksumList []string
 
-	if checksumList, found = ct[cacheKey]; !found {
-		// Create checksum dir and set group bit (all new files will inherit the directory's group). This allows for
-		// different users (being part of that group) to create, modify and delete the contained checksum and log files.
-		createChecksumDirCmd := fmt.Sprintf("mkdir -m2775 -p %s", checksumDir)
-
-		cmd, e := build.prepareInternalCommand(createChecksumDirCmd)
-		if e != nil {
+	checksumList, found = ct[cacheKey]
+	tsk.cachedChecksums = checksumList
+	if !found {
+		if e := build.state().PrepareTask(build, tsk.name); e != nil {
 			return e
 		}
-		err := &bytes.Buffer{}
-
-		cmd.SetStderr(err)
-
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf(err.String() + ": " + e.Error())
+	}
+	for _, cmd := range tsk.commands {
+		if e := cmd.prepare(build.environment(cmd)); e != nil {
+			return e
 		}
 	}
+	if tsk.handler {
+		return nil // handlers are never cached
+	}
 
 	// find commands that need not be executed
 	for i, cmd := range tsk.commands {
-		checksum, e := commandChecksum(cmd.command)
-		if e != nil {
-			return e
-		}
-
-		switch {
-		case len(checksumList) <= i || checksum != checksumList[i]:
-			return nil
-		default:
-			cmd.cached = true
+		if len(checksumList) <= i || cmd.Checksum() != checksumList[i] {
+			break
 		}
+		cmd.cached = true
 	}
 
+	index, e := build.invalidationIndex(tsk.name)
+	if e != nil {
+		return e
+	}
+	tsk.invalidate(index)
 	return nil
 }
 
-func (build *Build) buildTask(tsk *task) (e error) {
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
+func (build *Build) buildTask(ctx context.Context, tsk *task, tr *TaskResult) (e error) {
+	if tsk.handler && !build.handlers.isTriggered(tsk.name) {
+		return nil
+	}
 	tsk.started = time.Now()
+	tr.Started = tsk.started
+	defer func() {
+		tr.Finished = time.Now()
+	}()
+
+	if build.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, build.TaskTimeout)
+		defer cancel()
+	}
 
-	for _, cmd := range tsk.commands {
+	executed := false
+	for i, cmd := range tsk.commands {
 		checksum := cmd.Checksum()
 
 		m := message(pubsub.MessageTasksProvisionTask, build.hostname(), tsk.name)
@@ -216,28 +287,30 @@ func (build *Build) buildTask(tsk *task) (e error) {
 		switch {
 		case cmd.cached:
 			m.ExecStatus = pubsub.StatusCached
+			tr.Commands[i].Status = CommandCached
+		case ctx.Err() != nil:
+			return &InterruptError{TaskName: tsk.name, Checksum: checksum, Err: ctx.Err()}
 		default:
 			m.ExecStatus = pubsub.StatusExecStart
 			m.Publish("started")
-			status = constants.Status(strings.Join([]string{tsk.name ,STARTING},"."))
-			_ = eventNotify(build.Inputs,build.hostname())
-			r := &commandRunner{
-				build:       build,
-				command:     cmd.command,
-				dir:         checksumDir,
-				taskName:    tsk.name,
+			if !executed {
+				build.notify(EventTaskStarting, tsk.name, nil)
+				executed = true
 			}
-			cmdErr = r.run()
-      if cmdErr == nil {
-				status = constants.Status(strings.Join([]string{tsk.name,COMPLETED},"."))
-				_ = eventNotify(build.Inputs,build.hostname())
+			cmdErr = build.runCommand(ctx, tsk, cmd, tr.Commands[i])
+			// The triggered handlers are kept before the command is
+			// recorded, so that they can't get lost if it is cached.
+			if cmdErr == nil {
+				if e := build.handlers.trigger(cmd.triggers); e != nil {
+					return e
+				}
 			}
 			m.Error = cmdErr
 			m.ExecStatus = pubsub.StatusExecFinished
 		}
 		m.Publish("finished")
 
-		err := build.addCmdToTaskLog(tsk, checksumDir, checksum, cmdErr)
+		err := build.addCmdToTaskLog(tsk, checksum, cmdErr)
 		switch {
 		case cmdErr != nil:
 			return cmdErr
@@ -245,115 +318,100 @@ func (build *Build) buildTask(tsk *task) (e error) {
 			return err
 		}
 	}
-	return nil
-}
-
-func eventNotify(inputs map[string]string,host string) error {
-	var email,hostid string
-	for k,v := range inputs {
-		switch k {
-		case constants.USERMAIL:
-			email = v
-		case constants.HOST_ID:
-			hostid = v
-		}
+	if tsk.handler {
+		if e := build.handlers.executed(tsk.name); e != nil {
+			return e
 		}
-	mi := make(map[string]string)
-	js := make(pairs.JsonPairs, 0)
-	m := make(map[string][]string, 2)
-	m["status"] = []string{status.String()}
-	m["description"] = []string{status.Description(host)}
-	js.NukeAndSet(m) //just nuke the matching output key:
-
-	mi[constants.HOST_IP] = host
-	mi[constants.HOST_ID] = hostid
-	mi[constants.ACCOUNT_ID] = email
-	mi[constants.EVENT_TYPE] = status.Event_type()
-	newEvent := events.NewMulti(
-		[]*events.Event{
-			&events.Event{
-				AccountsId:  email,
-				EventAction: alerts.STATUS,
-				EventType:   constants.EventUser,
-				EventData:   alerts.EventData{M: mi, D: js.ToString()},
-				Timestamp:   time.Now().Local(),
-			},
-		})
-	return newEvent.Write()
+	}
+	if executed {
+		build.notify(EventTaskCompleted, tsk.name, nil)
+	}
+	return nil
 }
 
-// addCmdToTaskLog will manage the log of run commands in a file. This file gets append the path to a file
-// for each command, that contains the executed script. The filename contains either ".done" or ".failed" as
-// suffix, depending on the err given (nil or not).
-func (build *Build) addCmdToTaskLog(tsk *task, checksumDir, checksum string, err error) (e error) {
-	prefix := checksumDir + "/" + checksum
-	sourceFile := prefix + ".sh"
-	targetFile := prefix + ".done"
+// addCmdToTaskLog records the command's result in the build's state store.
+func (build *Build) addCmdToTaskLog(tsk *task, checksum string, err error) (e error) {
 	if err != nil {
 		logError(err)
-		targetFile = prefix + ".failed"
 	}
-	rawCmd := fmt.Sprintf("{ [ -f %[1]s ] || mv %[2]s %[1]s; } && echo %[1]s >> %[3]s/%[4]s.run",
-		targetFile, sourceFile, checksumDir, tsk.started.Format("20060102_150405"))
-	c, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return e
-	}
-
-	return c.Run()
+	return build.state().RecordCommand(build, tsk.name, checksum, tsk.started, err)
 }
 
 type checksumTree map[string][]string
 
-func (build *Build) buildChecksumTree() (ct checksumTree, e error) {
-	ct = checksumTree{}
+func (build *Build) buildChecksumTree() (checksumTree, error) {
+	return build.state().ChecksumTree(build)
+}
 
-	rawCmd := fmt.Sprintf(
-		`[ -d %[1]s ] && { ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.run | head -n1 | xargs cat; done; }`,
-		ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return nil, e
-	}
-	out := &bytes.Buffer{}
-	err := &bytes.Buffer{}
+var validNamespace = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]*$`)
 
-	cmd.SetStdout(out)
-	cmd.SetStderr(err)
+// Directory in the cache directory containing the caches of namespaces. It is
+// hidden, so that it can't be mistaken for a task of the cache directory.
+const namespacesDir = ".namespaces"
 
-	if e := cmd.Run(); e != nil {
-		return nil, fmt.Errorf("%s: out=%s err=%s", e.Error(), out.String(), err.String())
+// The directory of the build's cache on the target, i.e. the cache directory
+// or the namespace's directory in it.
+func (build *Build) cacheDir() string {
+	dir := build.CacheDir
+	if dir == "" {
+		dir = ukCACHEDIR
 	}
+	if build.Namespace != "" {
+		dir = strings.TrimSuffix(dir, "/") + "/" + namespacesDir + "/" + build.Namespace
+	}
+	return dir
+}
 
-	for _, line := range strings.Split(out.String(), "\n") {
-		line = strings.TrimSpace(line)
-
-		if line == "" || !strings.HasSuffix(line, ".done") {
-			continue
-		}
-
-		pkgname := filepath.Dir(strings.TrimPrefix(line, ukCACHEDIR+"/"))
-		checksum := strings.TrimSuffix(filepath.Base(line), ".done")
-		if len(checksum) != 64 {
-			return nil, fmt.Errorf("invalid checksum %q found for package %q", checksum, pkgname)
-		}
-		ct[pkgname] = append(ct[pkgname], checksum)
+func (build *Build) cacheGroup() string {
+	if build.CacheGroup == "" {
+		return ukGROUP
 	}
+	return build.CacheGroup
+}
 
-	return ct, nil
+func (build *Build) state() StateStore {
+	if build.State == nil {
+		return defaultStateStore
+	}
+	return build.State
 }
 
+// prepareCommand returns the given command escalated to run as root.
 func (build *Build) prepareCommand(rawCmd string) (target.ExecCommand, error) {
-	var sudo string
-	if build.User() != "root" {
-		sudo = "sudo "
+	return build.prepareCommandAs(rawCmd, "")
+}
+
+// prepareCommandAs returns the given command escalated to run as the given
+// user (root if empty).
+func (build *Build) prepareCommandAs(rawCmd, user string) (target.ExecCommand, error) {
+	rawCmd, e := build.escalate(rawCmd, user)
+	if e != nil {
+		return nil, e
 	}
-	return build.Command(sudo + rawCmd)
+	c, e := build.Command(rawCmd)
+	if e != nil || build.Escalation != EscalationSudoPassword {
+		return c, e
+	}
+	return &passwordCommand{ExecCommand: c, password: build.EscalationPassword}, nil
+}
+
+// renderScript returns the content of the script file executed for the given
+// command, with the given variables set in addition to the build's.
+func (build *Build) renderScript(c cmd.Command, env []string) string {
+	vars := exports(append(append([]string{}, build.Env...), env...))
+	if vars != "" {
+		vars += "\n"
+	}
+	return fmt.Sprintf("#!/bin/sh\nset -e\nset -x\n\n%s\n%s", vars, c.Shell())
 }
 
 func (build *Build) prepareInternalCommand(rawCmd string) (target.ExecCommand, error) {
 	rawCmd = fmt.Sprintf("sh -x -e <<\"EOC\"\n%s\nEOC\n", rawCmd)
-	return build.prepareCommand(rawCmd)
+	c := &internalCommand{build: build, rawCmd: rawCmd}
+	if e := c.renew(); e != nil {
+		return nil, e
+	}
+	return c, nil
 }
 
 func (build *Build) hostname() string {
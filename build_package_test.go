@@ -1,7 +1,16 @@
 package urknall
 
 import (
+	"bufio"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type testPackageBuilder struct {
@@ -28,3 +37,126 @@ func TestBuildPackage(t *testing.T) {
 		t.Errorf("expected pkg to have 1 task, got %d", len(pkg.tasks))
 	}
 }
+
+func TestBuildCommandTimeout(t *testing.T) {
+	ft := &fakeTarget{name: "slow", delay: time.Second}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate), CommandTimeout: 10 * time.Millisecond}
+
+	started := time.Now()
+	e := b.Run()
+	if !IsTimeout(e) {
+		t.Fatalf("expected a timeout error, got %v", e)
+	}
+	if d := time.Since(started); d >= time.Second {
+		t.Errorf("expected command to be killed, but build took %s", d)
+	}
+
+	recorded := false
+	for _, c := range ft.commands {
+		recorded = recorded || strings.Contains(c, ".failed")
+	}
+	if !recorded {
+		t.Errorf("expected killed command to be recorded as failed")
+	}
+}
+
+func TestBuildCancelled(t *testing.T) {
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := b.RunContext(ctx)
+	if ie, ok := e.(*InterruptError); !ok {
+		t.Fatalf("expected error of type %T, got %T", ie, e)
+	} else if ie.Timeout() {
+		t.Errorf("didn't expect cancellation to be a timeout")
+	}
+}
+
+func TestKillGroupOnInterrupt(t *testing.T) {
+	c := exec.Command("bash", "-c", killGroupOnInterrupt+`sh -c 'read -r line; echo "$line"; sleep 30 & echo $!; wait'`)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Stdin = strings.NewReader("input\n")
+	stdout, e := c.StdoutPipe()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	out := bufio.NewReader(stdout)
+	line, _ := out.ReadString('\n')
+	pidLine, _ := out.ReadString('\n')
+	pid, e := strconv.Atoi(strings.TrimSpace(pidLine))
+	if e != nil {
+		c.Process.Kill()
+		t.Fatalf("expected the child's pid, got %q (%v)", pidLine, e)
+	}
+	if line != "input\n" {
+		t.Errorf("expected the script to read stdin, got %q", line)
+	}
+
+	// Only the top process is signalled, like sudo passes the signal on.
+	if e = c.Process.Signal(syscall.SIGTERM); e != nil {
+		t.Fatal(e)
+	}
+	if e = c.Wait(); e == nil {
+		t.Errorf("expected the interrupted command to fail")
+	}
+	for i := 0; syscall.Kill(pid, 0) == nil && !zombie(pid); i++ {
+		if i > 100 {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("expected child process %d to be killed", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// zombie returns whether the process with the given pid is a zombie.
+func zombie(pid int) bool {
+	stat, e := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if e != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestBuildCacheDir(t *testing.T) {
+	data := []struct {
+		build    *Build
+		expected string
+	}{
+		{&Build{}, "/var/lib/urknall"},
+		{&Build{Namespace: "project"}, "/var/lib/urknall/.namespaces/project"},
+		{&Build{CacheDir: "/opt/cache/", Namespace: "project"}, "/opt/cache/.namespaces/project"},
+		{&Build{CacheDir: "/opt/cache"}, "/opt/cache"},
+	}
+
+	for _, d := range data {
+		if dir := d.build.cacheDir(); dir != d.expected {
+			t.Errorf("expected cache dir %q, got %q", d.expected, dir)
+		}
+	}
+}
+
+func TestBuildNamespace(t *testing.T) {
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate), Namespace: "team-a", CacheGroup: "team"}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	for _, c := range ft.commands {
+		if strings.Contains(c, ukCACHEDIR+"/base") {
+			t.Errorf("expected cache to be namespaced, got command %q", c)
+		}
+	}
+
+	for _, ns := range []string{"../etc", "..", ".", ".hidden"} {
+		b = &Build{Target: ft, Template: TemplateFunc(fleetTemplate), Namespace: ns}
+		if e := b.Run(); e == nil {
+			t.Errorf("expected invalid namespace %q to be rejected", ns)
+		}
+	}
+}
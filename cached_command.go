@@ -1,15 +1,40 @@
 package urknall
 
-import "github.com/megamsys/urknall/cmd"
+import (
+	"io/ioutil"
+
+	"github.com/megamsys/urknall/cmd"
+)
 
 type commandWrapper struct {
-	command cmd.Command
-	cached  bool
+	command     cmd.Command
+	cached      bool
+	invalidated bool     // cached, but executed due to the build's invalidation options
+	triggers    []string // names of the handlers triggered if executed
+	env         []string // environment variables of the task and the command
 
 	checksum string
+	input    []byte // the input of StdinConsumers, read when preparing the command
 	logMsg   string
 }
 
+// prepare reads the command's input and computes its checksum using the given
+// environment.
+func (cw *commandWrapper) prepare(env []string) (e error) {
+	if sc, ok := cw.command.(cmd.StdinConsumer); ok {
+		in := sc.Input()
+		defer in.Close()
+		if cw.input, e = ioutil.ReadAll(in); e != nil {
+			return e
+		}
+		if cw.input == nil {
+			cw.input = []byte{}
+		}
+	}
+	cw.checksum, e = checksumWith(cw.command, env, cw.input)
+	return e
+}
+
 func (cw *commandWrapper) Checksum() string {
 	if cw.checksum == "" {
 		var e error
@@ -28,5 +53,6 @@ func (cw *commandWrapper) LogMsg() string {
 		cw.logMsg = cw.command.Shell()
 	}
 
+	cw.logMsg = maskSecrets(cw.logMsg)
 	return cw.logMsg
 }
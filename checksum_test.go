@@ -0,0 +1,76 @@
+package urknall
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/megamsys/urknall/cmd"
+)
+
+type inputCommand struct {
+	cmd.Command
+	content string
+	reads   int
+}
+
+func (c *inputCommand) Input() io.ReadCloser {
+	c.reads++
+	return ioutil.NopCloser(strings.NewReader(c.content))
+}
+
+func TestChecksumWith(t *testing.T) {
+	base, _ := commandChecksum(Shell("echo a"))
+	plain, _ := checksumWith(Shell("echo a"), nil, nil)
+	if plain != base {
+		t.Errorf("expected checksum without environment and input to be %q, got %q", base, plain)
+	}
+
+	withEnv, _ := checksumWith(Shell("echo a"), []string{"FOO=bar"}, nil)
+	otherEnv, _ := checksumWith(Shell("echo a"), []string{"FOO=baz"}, nil)
+	withInput, _ := checksumWith(Shell("echo a"), nil, []byte("content"))
+	emptyInput, _ := checksumWith(Shell("echo a"), nil, []byte{})
+	seen := map[string]bool{base: true}
+	for _, c := range []string{withEnv, otherEnv, withInput, emptyInput} {
+		if len(c) != 64 {
+			t.Errorf("expected checksum of length 64, got %q", c)
+		}
+		if seen[c] {
+			t.Errorf("expected checksums to differ, got %q twice", c)
+		}
+		seen[c] = true
+	}
+
+	custom, _ := checksumWith(&testCommandCustomChecksum{&testCommand{}}, []string{"FOO=bar"}, nil)
+	if custom == withEnv || len(custom) != 64 {
+		t.Errorf("expected custom checksum to be combined with environment, got %q", custom)
+	}
+}
+
+func TestBuildStdinChecksum(t *testing.T) {
+	c := &inputCommand{Command: Shell("cat > /tmp/file"), content: "v1"}
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: TemplateFunc(func(pkg Package) { pkg.AddCommands("file", c) })}
+
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if c.reads != 1 {
+		t.Errorf("expected input to be read once, got %d", c.reads)
+	}
+	v1, _ := checksumWith(c, nil, []byte("v1"))
+	if cnt := countCommands(ft, "sh "+ukCACHEDIR+"/file/"+v1+".sh"); cnt != 1 {
+		t.Errorf("expected command to be executed with checksum of input, got %d", cnt)
+	}
+
+	c.content = "v2"
+	ft.outputs = map[string]string{"*.run": ukCACHEDIR + "/file/" + v1 + ".done\n"}
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if plan.Tasks[0].Commands[0].Cached {
+		t.Errorf("expected command with changed input not to be cached")
+	}
+}
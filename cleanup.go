@@ -0,0 +1,142 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/megamsys/urknall/pubsub"
+)
+
+// A retention policy defines which entries of a target's cache are removed on
+// cleanup. The latest run of each task is always kept, as it is required for
+// caching. Scripts and logs not referenced by any kept run are removed.
+type RetentionPolicy struct {
+	KeepRuns           int           // Maximum number of runs kept per task (no limit if 0).
+	MaxAge             time.Duration // Runs older than this are removed (no limit if 0).
+	RemoveUnknownTasks bool          // Remove the cache of tasks not part of the build's template.
+}
+
+// State stores implementing the Pruner interface support cleaning up their
+// cache (see Build.Cleanup). The tasks given are those of the build's template
+// and the returned entries identify what was removed.
+type Pruner interface {
+	Prune(b *Build, tasks []string, policy *RetentionPolicy) (removed []string, e error)
+}
+
+// Cleanup removes entries from the target's cache according to the given
+// policy. Removed entries are returned and published using the
+// pubsub.MessageCleanupCacheEntries key.
+func (b *Build) Cleanup(policy *RetentionPolicy) ([]string, error) {
+	if e := b.prepareTarget(); e != nil {
+		return nil, e
+	}
+	defer b.releaseLock()
+
+	var tasks []string
+	switch {
+	case b.Template != nil:
+		pkg, e := b.render()
+		if e != nil {
+			return nil, e
+		}
+		for _, t := range pkg.tasks {
+			tasks = append(tasks, t.name)
+		}
+	case policy.RemoveUnknownTasks:
+		return nil, fmt.Errorf("template required to remove unknown tasks")
+	}
+	return b.cleanup(tasks, policy)
+}
+
+func (b *Build) cleanup(tasks []string, policy *RetentionPolicy) ([]string, error) {
+	m := message(pubsub.MessageCleanupCacheEntries, b.hostname(), "")
+	pruner, ok := b.state().(Pruner)
+	if !ok {
+		e := fmt.Errorf("state store %T doesn't support cleanup", b.state())
+		m.PublishError(e)
+		return nil, e
+	}
+
+	removed, e := pruner.Prune(b, tasks, policy)
+	m.InvalidatedCacheEntries = removed
+	if e != nil {
+		m.PublishError(e)
+		return removed, e
+	}
+	m.Publish("finished")
+	return removed, nil
+}
+
+// keep decides for the given runs (sorted latest first) which to keep.
+func (policy *RetentionPolicy) keep(runs []time.Time, now time.Time) []bool {
+	keep := make([]bool, len(runs))
+	for i, run := range runs {
+		switch {
+		case i == 0:
+			keep[i] = true
+		case policy.KeepRuns > 0 && i >= policy.KeepRuns:
+		case policy.MaxAge > 0 && !run.IsZero() && now.Sub(run) > policy.MaxAge:
+		default:
+			keep[i] = true
+		}
+	}
+	return keep
+}
+
+// The content of a task's directory in the target's cache: the names of all
+// files and the entries of each run file.
+type cacheTaskListing struct {
+	files []string
+	runs  map[string][]string
+}
+
+// prunable returns the files of the listing that can be removed according to
+// the policy.
+func (policy *RetentionPolicy) prunable(l *cacheTaskListing, now time.Time) []string {
+	runNames := []string{}
+	for _, f := range l.files {
+		if strings.HasSuffix(f, ".run") {
+			runNames = append(runNames, f)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runNames)))
+
+	runTimes := make([]time.Time, len(runNames))
+	for i, name := range runNames {
+		// Runs with unparsable names have the zero time and are never removed due to their age.
+		runTimes[i], _ = time.ParseInLocation("20060102_150405", strings.TrimSuffix(name, ".run"), time.Local)
+	}
+
+	referenced := map[string]bool{}
+	removed := map[string]bool{}
+	for i, keep := range policy.keep(runTimes, now) {
+		if !keep {
+			removed[runNames[i]] = true
+			continue
+		}
+		referenced[runNames[i]] = true
+		for _, entry := range l.runs[runNames[i]] {
+			name := entry[strings.LastIndex(entry, "/")+1:]
+			referenced[name] = true
+			for _, suffix := range []string{".done", ".failed"} {
+				if strings.HasSuffix(name, suffix) {
+					referenced[strings.TrimSuffix(name, suffix)+".log"] = true
+				}
+			}
+		}
+	}
+
+	files := []string{}
+	for _, f := range l.files {
+		switch {
+		case removed[f]:
+			files = append(files, f)
+		case referenced[f]:
+		case strings.HasSuffix(f, ".sh"), strings.HasSuffix(f, ".log"), strings.HasSuffix(f, ".done"), strings.HasSuffix(f, ".failed"):
+			files = append(files, f)
+		}
+	}
+	return files
+}
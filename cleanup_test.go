@@ -0,0 +1,172 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCacheListing = `file a/20230101_000000.run
+file a/20240101_000000.run
+file a/20240102_000000.run
+file a/old.done
+file a/old.log
+file a/x.done
+file a/x.log
+file a/y.failed
+file a/crashed.sh
+run a/20230101_000000.run /var/lib/urknall/a/old.done
+run a/20240101_000000.run /var/lib/urknall/a/y.failed
+run a/20240102_000000.run /var/lib/urknall/a/x.done
+file b/z.done
+`
+
+func TestParseCacheListing(t *testing.T) {
+	listing := parseCacheListing(testCacheListing)
+	if len(listing) != 2 {
+		t.Fatalf("expected %d tasks, got %d", 2, len(listing))
+	}
+	if len(listing["a"].files) != 9 {
+		t.Errorf("expected %d files, got %d", 9, len(listing["a"].files))
+	}
+	if len(listing["b"].files) != 1 {
+		t.Errorf("expected %d files, got %d", 1, len(listing["b"].files))
+	}
+	if runs := listing["a"].runs["20240102_000000.run"]; !reflect.DeepEqual(runs, []string{"/var/lib/urknall/a/x.done"}) {
+		t.Errorf("unexpected run entries %v", runs)
+	}
+}
+
+func TestRetentionPolicyPrunable(t *testing.T) {
+	listing := parseCacheListing(testCacheListing)["a"]
+	now := time.Date(2024, 1, 3, 0, 0, 0, 0, time.Local)
+
+	data := []struct {
+		policy   *RetentionPolicy
+		expected []string
+	}{
+		{&RetentionPolicy{}, []string{"crashed.sh"}},
+		{&RetentionPolicy{KeepRuns: 2}, []string{"20230101_000000.run", "old.done", "old.log", "crashed.sh"}},
+		{&RetentionPolicy{KeepRuns: 1}, []string{"20230101_000000.run", "20240101_000000.run", "old.done", "old.log", "y.failed", "crashed.sh"}},
+		{&RetentionPolicy{MaxAge: 48 * time.Hour}, []string{"20230101_000000.run", "old.done", "old.log", "crashed.sh"}},
+		{&RetentionPolicy{MaxAge: time.Hour}, []string{"20230101_000000.run", "20240101_000000.run", "old.done", "old.log", "y.failed", "crashed.sh"}},
+	}
+
+	for i, d := range data {
+		if files := d.policy.prunable(listing, now); !reflect.DeepEqual(files, d.expected) {
+			t.Errorf("%d: expected %v, got %v", i, d.expected, files)
+		}
+	}
+}
+
+func TestJSONStateStorePrune(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewJSONStateStore(filepath.Join(dir, "state.json"))
+	b := &Build{Target: &fakeTarget{name: "host"}, State: store}
+	if e := store.Prepare(b); e != nil {
+		t.Fatal(e)
+	}
+	store.RecordCommand(b, "a", "old", time.Now().Add(-time.Hour), nil)
+	store.RecordCommand(b, "a", "new", time.Now(), nil)
+	store.RecordCommand(b, "b", "other", time.Now(), nil)
+	store.task(b, "a").Scripts["old"] = "echo old"
+	store.task(b, "a").Scripts["new"] = "echo new"
+
+	removed, e := store.Prune(b, []string{"a"}, &RetentionPolicy{KeepRuns: 1, RemoveUnknownTasks: true})
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if len(removed) != 3 {
+		t.Errorf("expected %d removed entries, got %v", 3, removed)
+	}
+
+	ct, _ := store.ChecksumTree(b)
+	if !reflect.DeepEqual(ct, map[string][]string{"a": {"new"}}) {
+		t.Errorf("unexpected checksum tree %v", ct)
+	}
+	if _, e := store.Script(b, "a", "old"); e == nil {
+		t.Errorf("expected script of removed run to be gone")
+	}
+}
+
+// shellTarget runs commands with the local shell. As its user is root, no
+// escalation is used.
+type shellTarget struct {
+	Target
+}
+
+func (shellTarget) User() string { return "root" }
+
+func TestTargetStateStoreNamespaces(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	checksum := func(c string) string { return strings.Repeat(c, 64) }
+	files := map[string]string{
+		"base/20240101_000000.run":                          dir + "/base/" + checksum("a") + ".done\n",
+		"base/" + checksum("a") + ".done":                   "",
+		".namespaces/team-a/.v2":                            "",
+		".namespaces/team-a/app/20240101_000000.run":        dir + "/.namespaces/team-a/app/" + checksum("b") + ".done\n",
+		".namespaces/team-a/app/" + checksum("b") + ".done": "",
+		".namespaces/team-b/.v2":                            "",
+		".namespaces/team-b/db/" + checksum("c") + ".done":  "",
+		"web/20240101_000000.run":                           dir + "/web/" + checksum("d") + ".done\n",
+		"web/" + checksum("d") + ".done":                    "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+			t.Fatal(e)
+		}
+		if e := ioutil.WriteFile(path, []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	local, _ := NewLocalTarget()
+	store := &targetStateStore{}
+	b := &Build{Target: shellTarget{local}, CacheDir: dir}
+
+	ct, e := store.ChecksumTree(b)
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	expected := map[string][]string{"base": {checksum("a")}, "web": {checksum("d")}}
+	if !reflect.DeepEqual(ct, expected) {
+		t.Errorf("expected checksum tree %v, got %v", expected, ct)
+	}
+
+	removed, e := store.Prune(b, []string{"base"}, &RetentionPolicy{RemoveUnknownTasks: true})
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if !reflect.DeepEqual(removed, []string{"web/"}) {
+		t.Errorf("expected only the unknown task to be removed, got %v", removed)
+	}
+	for _, name := range []string{"base", ".namespaces/team-a/app", ".namespaces/team-b/db"} {
+		if _, e := os.Stat(filepath.Join(dir, name)); e != nil {
+			t.Errorf("expected %s to be kept, got %q", name, e)
+		}
+	}
+
+	b.Namespace = "team-a"
+	ct, e = store.ChecksumTree(b)
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if expected := map[string][]string{"app": {checksum("b")}}; !reflect.DeepEqual(ct, expected) {
+		t.Errorf("expected checksum tree %v, got %v", expected, ct)
+	}
+}
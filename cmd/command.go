@@ -3,7 +3,10 @@
 // This package contains a set of interfaces, commands must or can implement.
 package cmd
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // The Command interface is used to have specialized commands that are used for
 // execution and logging (the latter is useful to hide the gory details of more
@@ -21,13 +24,29 @@ type Logger interface {
 
 // If a command needs to send something to the remote host (a file for example)
 // the content can be made available on standard input of the remote command.
-// The command must make sure that changed local content will reissue execution
-// of the command (by printing the content's hash to standard output for
-// example).
+// The input is read once, when the build is prepared, and its digest is part
+// of the command's checksum, i.e. changed local content will reissue execution
+// of the command.
 type StdinConsumer interface {
 	Input() io.ReadCloser
 }
 
+// Commands implementing the Environment interface have the returned variables
+// (in the form `KEY=VALUE`) set, in addition to those of the build and the
+// task. The variables are rendered using the template and are part of the
+// command's checksum.
+type Environment interface {
+	Env() []string
+}
+
+// Commands implementing the Checksummer interface contribute their own
+// fingerprint, used instead of the hash of the shell code to decide whether a
+// cached command must be executed again. The build's environment and the
+// command's input are taken into account in addition.
+type Checksummer interface {
+	Checksum() string
+}
+
 // Often it is convenient to directly use values or methods of the template in
 // the commands (using go's templating mechanism).
 type Renderer interface {
@@ -39,3 +58,31 @@ type Renderer interface {
 type Validator interface {
 	Validate() error
 }
+
+// Commands implementing the Timeouter interface are killed if they run longer
+// than the returned duration. This overrides the build's default command
+// timeout.
+type Timeouter interface {
+	Timeout() time.Duration
+}
+
+// Commands implementing the Trigger interface notify the handlers with the
+// returned names (see urknall.AddHandler), if they are executed.
+type Trigger interface {
+	Triggers() []string
+}
+
+// A retry policy defines whether and how often a failed command is executed
+// again.
+type RetryPolicy struct {
+	Attempts   int           // Maximum number of executions, including the first one.
+	Backoff    time.Duration // Delay before the first retry, doubled for each further retry.
+	MaxBackoff time.Duration // Upper bound of the delay (no bound if 0).
+	ExitCodes  []int         // Only retry on these exit codes (on any failure if empty).
+}
+
+// Commands implementing the Retrier interface are retried on failure according
+// to the returned policy. This overrides the build's default retry policy.
+type Retrier interface {
+	RetryPolicy() *RetryPolicy
+}
@@ -2,7 +2,7 @@ package urknall
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
 	"io"
 	"log"
 	"sync"
@@ -10,86 +10,168 @@ import (
 
 	"github.com/megamsys/urknall/cmd"
 	"github.com/megamsys/urknall/target"
+	"golang.org/x/net/context"
 )
 
 // commandRunner is used to execute commands in a build.
 type commandRunner struct {
-	build   *Build
-	dir     string
-	command cmd.Command
+	build    *Build
+	command  cmd.Command
+	checksum string
+	input    []byte   // the command's input, if it is a StdinConsumer
+	env      []string // environment variables of the task and the command
 
 	taskName    string
 
 	commandStarted time.Time
+
+	// Statistics on the command's output, each written by the stream's forwarder only.
+	stdoutBytes, stderrBytes int64
+	stderrTail               []string
 }
 
-func (runner *commandRunner) run() error {
+func (runner *commandRunner) run(ctx context.Context) error {
 	runner.commandStarted = time.Now()
 
-	checksum, e := commandChecksum(runner.command)
+	if timeout := runner.timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	checksum := runner.checksum
+	script := runner.build.renderScript(runner.command, runner.env)
+	referenced, e := runner.build.secrets.referenced(script)
 	if e != nil {
 		return e
 	}
-	prefix := runner.dir + "/" + checksum
 
-	if e = runner.writeScriptFile(prefix); e != nil {
+	path, e := runner.build.state().WriteScript(runner.build, runner.taskName, checksum, script)
+	if e != nil {
 		return e
 	}
 
-	errors := make(chan error)
-	logs := runner.newLogWriter(prefix + ".log", errors)
+	// Secrets are sent on stdin, before the command's input.
+	rawCmd, stdin := "sh "+path, io.Reader(nil)
+	if len(referenced) > 0 {
+		rawCmd, stdin = withSecrets(path, referenced)
+	}
+	rawCmd = killGroupOnInterrupt + rawCmd
 
-	c, e := runner.build.prepareCommand("sh " + prefix + ".sh")
+	c, e := runner.build.prepareCommandAs(rawCmd, runner.build.BecomeUser)
 	if e != nil {
 		return e
 	}
+	// Creating the command might have replaced the target's connection, and
+	// with it the lock.
+	if e = runner.build.held.ensure(); e != nil {
+		return e
+	}
 
-	var wg sync.WaitGroup
-
-	// Get pipes for stdout and stderr and forward messages to logs channel.
 	stdout, e := c.StdoutPipe()
 	if e != nil {
 		return e
 	}
-	wg.Add(1)
-	go runner.forwardStream(logs, "stdout", &wg, stdout)
-
 	stderr, e := c.StderrPipe()
 	if e != nil {
 		return e
 	}
-	wg.Add(1)
+
+	// The log writer is started last, as it runs a command of its own, that
+	// is only finished by closing the logs channel.
+	errors := make(chan error)
+	logs := runner.newLogWriter(checksum, errors)
+
+	// Forward messages from stdout and stderr to the logs channel.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go runner.forwardStream(logs, "stdout", &wg, stdout)
 	go runner.forwardStream(logs, "stderr", &wg, stderr)
 
-	if sc, ok := runner.command.(cmd.StdinConsumer); ok {
-		c.SetStdin(sc.Input())
-		defer sc.Input().Close()
+	if runner.input != nil {
+		if stdin != nil {
+			stdin = io.MultiReader(stdin, bytes.NewReader(runner.input))
+		} else {
+			stdin = bytes.NewReader(runner.input)
+		}
+	}
+	if stdin != nil {
+		c.SetStdin(stdin)
 	}
 
-	e = c.Run()
+	if e = c.Start(); e == nil {
+		e = runner.wait(ctx, c, checksum)
+	}
 	wg.Wait()
 	close(logs)
 
 	// Get errors that might have occurred while handling the back-channel for the logs.
-	for e = range errors {
-		log.Printf("ERROR: %s", e.Error())
+	logErrors := []error{}
+	for err := range errors {
+		logError(err)
+		logErrors = append(logErrors, err)
 	}
-	return e
+	return runner.commandError(checksum, e, logErrors)
 }
 
-func (runner *commandRunner) writeScriptFile(prefix string) (e error) {
-	targetFile := prefix + ".sh"
-	env := ""
-	for _, e := range runner.build.Env {
-		env += "export " + e + "\n"
+// killGroupOnInterrupt prefixes the script's command, so that the TERM or INT
+// signal kills all processes the script started (e.g. a hanging apt-get) and
+// not only the shell, as the signal is usually only sent to the top process
+// (or passed on by sudo). The command runs in the background, as the shell
+// handles signals only after a foreground command finished, with the standard
+// input passed on explicitly.
+const killGroupOnInterrupt = `sh -c 'trap "trap - TERM; kill -TERM 0" INT TERM; exec 3<&0; "$@" <&3 3<&- & wait $!' sh `
+
+// commandError wraps the error of a command's execution into a CommandError.
+// Interrupts are returned as they are.
+func (runner *commandRunner) commandError(checksum string, e error, logErrors []error) error {
+	if _, ok := e.(*InterruptError); ok || (e == nil && len(logErrors) == 0) {
+		return e
+	}
+	ce := &CommandError{
+		TaskName:   runner.taskName,
+		Checksum:   checksum,
+		StderrTail: runner.stderrTail,
+		LogErrors:  logErrors,
+		Err:        e,
 	}
-	rawCmd := fmt.Sprintf("cat <<\"EOSCRIPT\" > %s\n#!/bin/sh\nset -e\nset -x\n\n%s\n%s\nEOSCRIPT\n", targetFile, env, runner.command.Shell())
-	c, e := runner.build.prepareInternalCommand(rawCmd)
 	if e != nil {
-		return e
+		ce.ExitCode = -1
+		if code, ok := target.ExitStatus(e); ok {
+			ce.ExitCode = code
+		}
+		ce.Signal, _ = target.ExitSignal(e)
 	}
+	return ce
+}
 
-	return c.Run()
+func (runner *commandRunner) timeout() time.Duration {
+	if t, ok := runner.command.(cmd.Timeouter); ok && t.Timeout() > 0 {
+		return t.Timeout()
+	}
+	return runner.build.CommandTimeout
+}
+
+// wait for the command to finish. If the context is done before, the command
+// is interrupted and an InterruptError returned.
+func (runner *commandRunner) wait(ctx context.Context, c target.ExecCommand, checksum string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	select {
+	case e := <-done:
+		return e
+	case <-ctx.Done():
+		if i, ok := c.(target.Interrupter); ok {
+			if e := i.Interrupt(); e != nil {
+				logError(e)
+			}
+		}
+		<-done
+		return &InterruptError{TaskName: runner.taskName, Checksum: checksum, Err: ctx.Err()}
+	}
 }
 
 func logError(e error) {
@@ -104,66 +186,65 @@ func (runner *commandRunner) forwardStream(logs chan <- string, stream string, w
 	if logger, ok := runner.command.(cmd.Logger); ok {
 		m.Message = logger.Logging()
 	}
+	m.Message = maskSecrets(m.Message)
 	m.Stream = stream
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		m.Line = scanner.Text()
+		line := maskSecrets(scanner.Text())
+		runner.countLine(stream, line)
+		m.Line = line
 		if m.Line == "" {
 			m.Line = " " // empty string would be printed differently therefore add some whitespace
 		}
 		m.TotalRuntime = time.Since(runner.commandStarted)
 		m.Publish(stream)
-		logs <- time.Now().UTC().Format(time.RFC3339Nano) + "\t" + stream + "\t" + scanner.Text()
+		logs <- time.Now().UTC().Format(time.RFC3339Nano) + "\t" + stream + "\t" + line
+	}
+}
+
+func (runner *commandRunner) countLine(stream, line string) {
+	switch stream {
+	case "stdout":
+		runner.stdoutBytes += int64(len(line)) + 1
+	case "stderr":
+		runner.stderrBytes += int64(len(line)) + 1
+		runner.stderrTail = append(runner.stderrTail, line)
+		if len(runner.stderrTail) > stderrTailLines {
+			runner.stderrTail = runner.stderrTail[1:]
+		}
 	}
 }
 
-func (runner *commandRunner) newLogWriter(path string, errors chan <- error) chan <- string {
+func (runner *commandRunner) newLogWriter(checksum string, errors chan <- error) chan <- string {
 	logs := make(chan string)
 
 	go func() {
 		defer close(errors)
 
-		cmd, err := runner.writeLogs(path, errors, logs)
-		switch {
-		case err != nil:
-			errors <- err
-		default:
-			if err := cmd.Wait(); err != nil {
-				errors <- err
+		w, err := runner.build.state().LogWriter(runner.build, runner.taskName, checksum)
+		if err != nil {
+			for range logs {
+				// Drain the channel, so that the command's output is still forwarded.
 			}
+			errors <- err
+			return
 		}
-	}()
-
-	return logs
-}
-
-func (runner *commandRunner) writeLogs(path string, errors chan <- error, logs <-chan string) (target.ExecCommand, error) {
-	// so ugly, but: sudo not required and "sh -c" adds some escaping issues with the variables. This is why Command is called directly.
-	cmd, err := runner.build.Command("cat - > " + path)
-	if err != nil {
-		return nil, err
-	}
-
-	// Get pipe to stdin of the execute command.
-	in, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, err
-	}
-	defer in.Close()
-
-	// Run command, writing everything coming from stdin to a file.
-	if err := cmd.Start(); err != nil {
-		in.Close()
-		return nil, err
-	}
 
-	// Send all messages from logs to the stdin of the new session.
-	for log := range logs {
-		if _, err = io.WriteString(in, log + "\n"); err != nil {
+		// Send all messages from logs to the writer.
+		var writeErr error
+		for log := range logs {
+			if _, err = io.WriteString(w, log + "\n"); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}
+		if writeErr != nil {
+			errors <- writeErr
+		}
+		if err := w.Close(); err != nil {
 			errors <- err
 		}
-	}
-	return cmd, err
+	}()
 
+	return logs
 }
@@ -0,0 +1,174 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Templates implementing the Dependent interface declare the tasks (or
+// templates) they depend on, when added to a package using AddTemplate. All of
+// the template's tasks are started only after those have finished.
+//
+// Names are resolved relative to the package the template is added to, i.e.
+// sibling tasks and templates can be referenced by their name. If there is no
+// such sibling, the enclosing packages are searched up to the root.
+type Dependent interface {
+	Dependencies() []string
+}
+
+// A dependency of a task on a task or template. The scope is the name of the
+// package the dependency was declared in.
+type dependency struct {
+	name  string
+	scope string
+}
+
+func (pkg *packageImpl) addDependencies(tasks []*task, names []string) {
+	for _, t := range tasks {
+		for _, name := range names {
+			t.dependencies = append(t.dependencies, dependency{name: name, scope: pkg.cacheKeyPrefix})
+		}
+	}
+}
+
+// resolveDependencies resolves the dependencies of all tasks and sorts the
+// tasks topologically. The order of tasks that don't depend on each other is
+// kept.
+func (pkg *packageImpl) resolveDependencies() error {
+	for _, t := range pkg.tasks {
+		t.deps = append([]*task{}, t.implicitDeps...)
+		for _, d := range t.dependencies {
+			deps := pkg.lookupDependency(t, d)
+			if len(deps) == 0 {
+				return fmt.Errorf("task %q depends on unknown task %q", t.name, d.name)
+			}
+			t.deps = append(t.deps, deps...)
+		}
+	}
+
+	sorted := make([]*task, 0, len(pkg.tasks))
+	added := map[*task]bool{}
+	for len(sorted) < len(pkg.tasks) {
+		next := -1
+		for i, t := range pkg.tasks {
+			if !added[t] && t.ready(added) {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return fmt.Errorf("dependency cycle between tasks %s", strings.Join(pkg.pendingTasks(added), ", "))
+		}
+		added[pkg.tasks[next]] = true
+		sorted = append(sorted, pkg.tasks[next])
+	}
+	pkg.tasks = sorted
+	return nil
+}
+
+// lookupDependency returns the tasks matching the given dependency, i.e. the
+// task with the dependency's name or all tasks of the template with that name.
+func (pkg *packageImpl) lookupDependency(t *task, d dependency) []*task {
+	scope := d.scope
+	for {
+		name := d.name
+		if scope != "" {
+			name = scope + "." + d.name
+		}
+		deps := []*task{}
+		for _, other := range pkg.tasks {
+			if other != t && !other.handler && (other.name == name || strings.HasPrefix(other.name, name+".")) {
+				deps = append(deps, other)
+			}
+		}
+		if len(deps) > 0 || scope == "" {
+			return deps
+		}
+		if i := strings.LastIndex(scope, "."); i != -1 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+func (pkg *packageImpl) pendingTasks(added map[*task]bool) []string {
+	names := []string{}
+	for _, t := range pkg.tasks {
+		if !added[t] {
+			names = append(names, t.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ready returns whether all dependencies of the task are done.
+func (t *task) ready(done map[*task]bool) bool {
+	for _, d := range t.deps {
+		if !done[d] {
+			return false
+		}
+	}
+	return true
+}
+
+type taskDone struct {
+	task *task
+	err  error
+}
+
+// buildTasks runs the given tasks (sorted topologically) with at most the
+// build's MaxParallelTasks running concurrently. Tasks are only started after
+// their dependencies finished successfully. After a task failed, no further
+// tasks are started, those still running are interrupted and the first error
+// is returned.
+func (b *Build) buildTasks(ctx context.Context, tasks []*task, results []*TaskResult) error {
+	if b.MaxParallelTasks <= 1 {
+		for i, task := range tasks {
+			if e := b.buildTask(ctx, task, results[i]); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	finished := make(chan taskDone)
+	started := map[*task]bool{}
+	done := map[*task]bool{}
+	running := 0
+	var err error
+	for {
+		for i, t := range tasks {
+			if err != nil || running >= b.MaxParallelTasks {
+				break
+			}
+			if started[t] || !t.ready(done) {
+				continue
+			}
+			started[t] = true
+			running++
+			go func(t *task, tr *TaskResult) {
+				finished <- taskDone{task: t, err: b.buildTask(ctx, t, tr)}
+			}(t, results[i])
+		}
+		if running == 0 {
+			return err
+		}
+
+		d := <-finished
+		running--
+		switch {
+		case d.err == nil:
+			done[d.task] = true
+		case err == nil:
+			err = d.err
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package urknall
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type dependentTemplate struct {
+	deps []string
+}
+
+func (tpl *dependentTemplate) Render(pkg Package) {
+	pkg.AddCommands("install", Shell("echo install"))
+	pkg.AddTask("start", DependsOn(NewTask().Add(Shell("echo start")), "config"))
+	pkg.AddCommands("config", Shell("echo config"))
+}
+
+func (tpl *dependentTemplate) Dependencies() []string {
+	return tpl.deps
+}
+
+func taskNames(pkg *packageImpl) []string {
+	names := []string{}
+	for _, t := range pkg.tasks {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+func TestResolveDependencies(t *testing.T) {
+	pkg, e := renderTemplate(TemplateFunc(func(pkg Package) {
+		pkg.AddTemplate("app", &dependentTemplate{deps: []string{"db"}})
+		pkg.AddTask("db", DependsOn(NewTask().Add(Shell("echo db")), "base"))
+		pkg.AddCommands("base", Shell("echo base"))
+	}), nil)
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+
+	expected := []string{"base", "db", "app.install", "app.config", "app.start"}
+	if names := taskNames(pkg); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected tasks %v, got %v", expected, names)
+	}
+}
+
+func TestResolveDependenciesErrors(t *testing.T) {
+	_, e := renderTemplate(TemplateFunc(func(pkg Package) {
+		pkg.AddTask("a", DependsOn(NewTask().Add(Shell("echo a")), "missing"))
+	}), nil)
+	if e == nil || !strings.Contains(e.Error(), `unknown task "missing"`) {
+		t.Errorf("expected unknown dependency error, got %v", e)
+	}
+
+	_, e = renderTemplate(TemplateFunc(func(pkg Package) {
+		pkg.AddTask("a", DependsOn(NewTask().Add(Shell("echo a")), "b"))
+		pkg.AddTask("b", DependsOn(NewTask().Add(Shell("echo b")), "app"))
+		pkg.AddTemplate("app", &dependentTemplate{deps: []string{"a"}})
+	}), nil)
+	if e == nil || !strings.Contains(e.Error(), "dependency cycle between tasks a, app.config, app.install, app.start, b") {
+		t.Errorf("expected dependency cycle error, got %v", e)
+	}
+}
+
+func TestBuildParallelTasks(t *testing.T) {
+	ft := &fakeTarget{name: "host", delay: 50 * time.Millisecond}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("a", Shell("echo a"))
+		pkg.AddCommands("b", Shell("echo b"))
+		pkg.AddCommands("c", Shell("echo c"))
+		pkg.AddTask("d", DependsOn(NewTask().Add(Shell("echo d")), "a", "b", "c"))
+	})
+
+	res, e := (&Build{Target: ft, Template: tpl, MaxParallelTasks: 2}).RunWithResult(context.Background())
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if ft.maxRun != 2 {
+		t.Errorf("expected %d tasks to run concurrently, got %d", 2, ft.maxRun)
+	}
+	d := res.Tasks[3]
+	for _, tr := range res.Tasks[:3] {
+		if d.Started.Before(tr.Finished) {
+			t.Errorf("expected task %q to be started after %q finished", d.Name, tr.Name)
+		}
+	}
+}
+
+func TestBuildParallelTasksFailure(t *testing.T) {
+	checksum, _ := commandChecksum(Shell("echo a"))
+	ft := &fakeTarget{name: "host", failing: "sh " + ukCACHEDIR + "/a/" + checksum + ".sh"}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("a", Shell("echo a"))
+		pkg.AddCommands("b", Shell("echo b"))
+		pkg.AddTask("c", DependsOn(NewTask().Add(Shell("echo c")), "a"))
+	})
+
+	res, e := (&Build{Target: ft, Template: tpl, MaxParallelTasks: 4}).RunWithResult(context.Background())
+	if _, ok := e.(*CommandError); !ok {
+		t.Fatalf("expected a *CommandError, got %#v", e)
+	}
+	if status := res.Tasks[2].Commands[0].Status; status != CommandSkipped {
+		t.Errorf("expected dependent task to be skipped, got %q", status)
+	}
+}
+
+func TestBuildParallelTasksFailureInterrupts(t *testing.T) {
+	checksumA, _ := commandChecksum(Shell("echo a"))
+	checksumB, _ := commandChecksum(Shell("echo b"))
+	ft := &fakeTarget{name: "host", failing: "sh " + ukCACHEDIR + "/a/" + checksumA + ".sh", slow: "sh " + ukCACHEDIR + "/b/" + checksumB + ".sh"}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("a", Shell("echo a"))
+		pkg.AddCommands("b", Shell("echo b"))
+	})
+
+	started := time.Now()
+	res, e := (&Build{Target: ft, Template: tpl, MaxParallelTasks: 2}).RunWithResult(context.Background())
+	if _, ok := e.(*CommandError); !ok {
+		t.Fatalf("expected a *CommandError, got %#v", e)
+	}
+	if d := time.Since(started); d > 10*time.Second {
+		t.Errorf("expected the running task to be interrupted, build took %s", d)
+	}
+	if status := res.Tasks[1].Commands[0].Status; status != CommandFailed {
+		t.Errorf("expected the interrupted command to be failed, got %q", status)
+	}
+}
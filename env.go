@@ -0,0 +1,68 @@
+package urknall
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/megamsys/urknall/cmd"
+	"github.com/megamsys/urknall/utils"
+)
+
+// Environment variables in the form `KEY=VALUE`. Added to a task (using
+// Package.AddCommands or Task.Add) they are set for all of the task's
+// commands, in addition to the build's Env, instead of being executed. Values
+// are rendered using the template, like commands.
+//
+//	pkg.AddCommands("build", urknall.Env{"GOPATH=/opt/go"}, Shell("go install ./..."))
+//
+// Variables of the task override those of the build, and those of a command
+// (see cmd.Environment) override those of the task. All of them are part of
+// the commands' checksums, i.e. changing them reissues execution.
+type Env []string
+
+// Shell returns the exports of the variables.
+func (env Env) Shell() string {
+	return exports(env)
+}
+
+var validEnvVar = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*=`)
+
+// renderEnv renders the environment variables of the given task and its
+// commands, and sets the resulting environment of each command.
+func (pkg *packageImpl) renderEnv(t *task) {
+	t.env = pkg.renderVars(t.env)
+	for _, c := range t.commands {
+		c.env = t.env
+		if e, ok := c.command.(cmd.Environment); ok {
+			c.env = append(append([]string{}, t.env...), pkg.renderVars(e.Env())...)
+		}
+	}
+}
+
+func (pkg *packageImpl) renderVars(vars []string) []string {
+	rendered := make([]string, 0, len(vars))
+	for _, v := range vars {
+		v = utils.MustRenderTemplate(v, pkg.reference)
+		if !validEnvVar.MatchString(v) {
+			panic(fmt.Sprintf("invalid environment variable %q (must be of the form KEY=VALUE)", v))
+		}
+		rendered = append(rendered, v)
+	}
+	return rendered
+}
+
+// environment returns the effective environment of the given command, i.e.
+// the build's variables followed by those of the command's task and the
+// command itself.
+func (build *Build) environment(c *commandWrapper) []string {
+	return append(append([]string{}, build.Env...), c.env...)
+}
+
+func exports(env []string) string {
+	s := ""
+	for _, e := range env {
+		s += "export " + e + "\n"
+	}
+	return strings.TrimSuffix(s, "\n")
+}
@@ -0,0 +1,68 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/megamsys/urknall/cmd"
+)
+
+type envCommand struct {
+	cmd.Command
+	env []string
+}
+
+func (c *envCommand) Env() []string {
+	return c.env
+}
+
+type envTemplate struct {
+	Version string
+}
+
+func (tpl *envTemplate) Render(pkg Package) {
+	pkg.AddCommands("cmds", Env{"VERSION={{ .Version }}"}, Shell("echo a"), &envCommand{Command: Shell("echo b"), env: []string{"B=1"}})
+	pkg.AddTask("task", NewTask().Add(Shell("echo c"), Env{"PROXY=http://proxy"}))
+}
+
+func TestBuildEnv(t *testing.T) {
+	b := &Build{Target: &fakeTarget{name: "host"}, Template: &envTemplate{Version: "1.2"}, Env: []string{"FOO=bar"}}
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if len(plan.Tasks) != 2 || len(plan.Tasks[0].Commands) != 2 {
+		t.Fatalf("expected Env not to be added as command, got %#v", plan.Tasks)
+	}
+
+	expected := [][]string{
+		{"FOO=bar", "VERSION=1.2"},
+		{"FOO=bar", "VERSION=1.2", "B=1"},
+		{"FOO=bar", "PROXY=http://proxy"},
+	}
+	scripts := []string{plan.Tasks[0].Commands[0].Script, plan.Tasks[0].Commands[1].Script, plan.Tasks[1].Commands[0].Script}
+	for i, script := range scripts {
+		if vars := exports(expected[i]); !strings.Contains(script, vars+"\n\n") {
+			t.Errorf("expected script %d to export %q, got %q", i, vars, script)
+		}
+	}
+
+	checksum, _ := checksumWith(Shell("echo a"), expected[0], nil)
+	if c := plan.Tasks[0].Commands[0].Checksum; c != checksum {
+		t.Errorf("expected checksum %q, got %q", checksum, c)
+	}
+}
+
+func TestInvalidEnv(t *testing.T) {
+	_, e := renderTemplate(TemplateFunc(func(pkg Package) {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(r.(string), "invalid environment variable") {
+				t.Errorf("expected invalid environment variable panic, got %v", r)
+			}
+		}()
+		pkg.AddCommands("a", Env{"no value"}, Shell("echo a"))
+	}), nil)
+	if e != nil {
+		t.Errorf("didn't expect an error, got %q", e)
+	}
+}
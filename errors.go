@@ -0,0 +1,64 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// The error returned if a build was aborted, because its context was cancelled
+// or a deadline (of the build, the task or the command) was exceeded.
+type InterruptError struct {
+	TaskName string // Name of the task that was interrupted.
+	Checksum string // Checksum of the interrupted command.
+	Err      error  // Either context.Canceled or context.DeadlineExceeded.
+}
+
+func (e *InterruptError) Error() string {
+	if e.Timeout() {
+		return fmt.Sprintf("task %q: command %.8s timed out", e.TaskName, e.Checksum)
+	}
+	return fmt.Sprintf("task %q: command %.8s interrupted: %s", e.TaskName, e.Checksum, e.Err)
+}
+
+// Predicate to verify whether the interrupt was caused by an exceeded deadline.
+func (e *InterruptError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
+
+// Predicate to verify whether the given error is an InterruptError caused by an
+// exceeded deadline.
+func IsTimeout(e error) bool {
+	ie, ok := e.(*InterruptError)
+	return ok && ie.Timeout()
+}
+
+// The error returned if a command of a build failed.
+type CommandError struct {
+	TaskName   string   // Name of the task the command belongs to.
+	Checksum   string   // Checksum of the failed command.
+	ExitCode   int      // Exit code of the command (-1 if it didn't exit normally).
+	Signal     string   // Signal the command was killed with (empty if none).
+	StderrTail []string // The last lines the command wrote to stderr.
+	LogErrors  []error  // Errors that occurred while writing the command's log.
+	Err        error    // Error returned by the target (nil if only writing the log failed).
+}
+
+func (e *CommandError) Error() string {
+	var msg string
+	switch {
+	case e.Err != nil:
+		msg = fmt.Sprintf("task %q: command %.8s failed: %s", e.TaskName, e.Checksum, e.Err)
+	default:
+		msg = fmt.Sprintf("task %q: command %.8s: failed to write log", e.TaskName, e.Checksum)
+	}
+	if len(e.LogErrors) > 0 {
+		logErrors := make([]string, len(e.LogErrors))
+		for i, err := range e.LogErrors {
+			logErrors[i] = err.Error()
+		}
+		msg += " (log errors: " + strings.Join(logErrors, "; ") + ")"
+	}
+	return msg
+}
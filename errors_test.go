@@ -0,0 +1,122 @@
+package urknall
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megamsys/urknall/target"
+)
+
+type failingLogStore struct {
+	StateStore
+}
+
+func (failingLogStore) LogWriter(b *Build, task, checksum string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("disk full")
+}
+
+func TestCommandErrorFromBuild(t *testing.T) {
+	checksum, _ := commandChecksum(Shell("echo base"))
+	ft := &fakeTarget{name: "host", failing: "sh " + ukCACHEDIR + "/base/" + checksum + ".sh"}
+	e := (&Build{Target: ft, Template: TemplateFunc(fleetTemplate)}).Run()
+
+	ce, ok := e.(*CommandError)
+	if !ok {
+		t.Fatalf("expected a *CommandError, got %#v", e)
+	}
+	if ce.TaskName != "base" || ce.Checksum != checksum {
+		t.Errorf("unexpected task %q and checksum %q", ce.TaskName, ce.Checksum)
+	}
+	if ce.ExitCode != -1 || ce.Err == nil || len(ce.LogErrors) != 0 {
+		t.Errorf("unexpected error %#v", ce)
+	}
+}
+
+// refusingTarget fails creating commands containing the given string.
+type refusingTarget struct {
+	*fakeTarget
+	refused string
+}
+
+func (rt *refusingTarget) Command(c string) (target.ExecCommand, error) {
+	if strings.Contains(c, rt.refused) {
+		return nil, fmt.Errorf("refused")
+	}
+	return rt.fakeTarget.Command(c)
+}
+
+// signalingLogStore reports the tasks log writers are requested for.
+type signalingLogStore struct {
+	StateStore
+	requested chan string
+}
+
+func (s signalingLogStore) LogWriter(b *Build, task, checksum string) (io.WriteCloser, error) {
+	s.requested <- task
+	return s.StateStore.LogWriter(b, task, checksum)
+}
+
+func TestCommandErrorNoLogWriter(t *testing.T) {
+	rt := &refusingTarget{fakeTarget: &fakeTarget{name: "host"}, refused: killGroupOnInterrupt}
+	store := signalingLogStore{StateStore: defaultStateStore, requested: make(chan string, 10)}
+	e := (&Build{Target: rt, Template: TemplateFunc(fleetTemplate), State: store}).Run()
+	if e == nil || !strings.Contains(e.Error(), "refused") {
+		t.Fatalf("expected command to be refused, got %v", e)
+	}
+	select {
+	case task := <-store.requested:
+		t.Errorf("expected no log writer to be started, got one for task %q", task)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCommandErrorLogErrors(t *testing.T) {
+	ft := &fakeTarget{name: "host"}
+	e := (&Build{Target: ft, Template: TemplateFunc(fleetTemplate), State: failingLogStore{defaultStateStore}}).Run()
+
+	ce, ok := e.(*CommandError)
+	if !ok {
+		t.Fatalf("expected a *CommandError, got %#v", e)
+	}
+	if ce.Err != nil || len(ce.LogErrors) != 1 {
+		t.Errorf("expected only a log error, got %#v", ce)
+	}
+	if !strings.Contains(ce.Error(), "disk full") {
+		t.Errorf("expected log error in message, got %q", ce.Error())
+	}
+}
+
+func TestCommandErrorExitStatus(t *testing.T) {
+	runner := &commandRunner{taskName: "base", stderrTail: []string{"oops"}}
+
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	ce, ok := runner.commandError("abc", err, nil).(*CommandError)
+	if !ok {
+		t.Fatalf("expected a *CommandError, got %#v", err)
+	}
+	if ce.ExitCode != 3 || ce.Signal != "" {
+		t.Errorf("expected exit code %d without signal, got %d and %q", 3, ce.ExitCode, ce.Signal)
+	}
+	if !reflect.DeepEqual(ce.StderrTail, []string{"oops"}) {
+		t.Errorf("unexpected stderr tail %v", ce.StderrTail)
+	}
+
+	err = exec.Command("sh", "-c", "kill -9 $$").Run()
+	ce = runner.commandError("abc", err, nil).(*CommandError)
+	if ce.ExitCode != -1 || ce.Signal != "killed" {
+		t.Errorf("expected command to be killed, got exit code %d and signal %q", ce.ExitCode, ce.Signal)
+	}
+
+	if e := runner.commandError("abc", nil, nil); e != nil {
+		t.Errorf("didn't expect an error, got %q", e)
+	}
+	ie := &InterruptError{}
+	if e := runner.commandError("abc", ie, nil); e != ie {
+		t.Errorf("expected interrupt to be returned as is, got %#v", e)
+	}
+}
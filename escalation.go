@@ -0,0 +1,141 @@
+package urknall
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/megamsys/urknall/target"
+)
+
+// An escalation strategy defines how commands (both the template's and those
+// urknall uses for bookkeeping) gain the privileges required on the target.
+// Bookkeeping commands always run as root, the template's commands as the
+// build's BecomeUser.
+type Escalation string
+
+const (
+	// Use sudo, unless the target's user is root and no become user is set.
+	EscalationDefault Escalation = ""
+	// Run commands with the privileges of the target's user.
+	EscalationNone Escalation = "none"
+	// Use sudo, requiring passwordless sudo for the target's user.
+	EscalationSudo Escalation = "sudo"
+	// Use sudo with the build's EscalationPassword sent on standard input. The
+	// cached credentials are ignored, so that sudo always reads the password.
+	// Must only be used if sudo requires a password, as the password would be
+	// passed on to the command otherwise.
+	EscalationSudoPassword Escalation = "sudo-password"
+	// Use doas, requiring a nopass rule for the target's user.
+	EscalationDoas Escalation = "doas"
+	// Use su, which only works without a password if the target's user is
+	// root, i.e. to run commands as an unprivileged become user.
+	EscalationSu Escalation = "su"
+)
+
+var validUserName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// validateEscalation checks the build's escalation settings.
+func (build *Build) validateEscalation() error {
+	if build.BecomeUser != "" && !validUserName.MatchString(build.BecomeUser) {
+		return fmt.Errorf("invalid become user %q", build.BecomeUser)
+	}
+	switch build.Escalation {
+	case EscalationDefault, EscalationSudo, EscalationDoas, EscalationSu:
+		return nil
+	case EscalationNone:
+		if build.BecomeUser != "" {
+			return fmt.Errorf("escalation %q doesn't support become user %q", build.Escalation, build.BecomeUser)
+		}
+		return nil
+	case EscalationSudoPassword:
+		if build.EscalationPassword == "" {
+			return fmt.Errorf("escalation %q requires a password", build.Escalation)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown escalation %q", build.Escalation)
+	}
+}
+
+// escalate returns the given command prefixed according to the build's
+// escalation strategy, so that it is run as the given user (root if empty).
+func (build *Build) escalate(rawCmd, user string) (string, error) {
+	if e := build.validateEscalation(); e != nil {
+		return "", e
+	}
+
+	asUser := ""
+	if user != "" {
+		asUser = "-u " + user + " "
+	}
+	switch build.Escalation {
+	case EscalationNone:
+		return rawCmd, nil
+	case EscalationSudo:
+		return "sudo " + asUser + rawCmd, nil
+	case EscalationSudoPassword:
+		// The command is wrapped, so that sudo reads the password from the
+		// command's standard input even if the command is given a heredoc.
+		return "sudo -k -S -p '' " + asUser + "sh -c " + shellQuote(rawCmd), nil
+	case EscalationDoas:
+		return "doas -n " + asUser + rawCmd, nil
+	case EscalationSu:
+		if user == "" {
+			user = "root"
+		}
+		return "su -s /bin/sh -c " + shellQuote(rawCmd) + " " + user, nil
+	}
+
+	if build.User() == "root" && user == "" {
+		return rawCmd, nil
+	}
+	return "sudo " + asUser + rawCmd, nil
+}
+
+// passwordCommand sends a password on standard input before the command's
+// input (see EscalationSudoPassword).
+type passwordCommand struct {
+	target.ExecCommand
+	password string
+
+	stdinSet bool
+	pipe     io.WriteCloser
+}
+
+func (c *passwordCommand) prompt() io.Reader {
+	return strings.NewReader(c.password + "\n")
+}
+
+func (c *passwordCommand) SetStdin(r io.Reader) {
+	c.stdinSet = true
+	c.ExecCommand.SetStdin(io.MultiReader(c.prompt(), r))
+}
+
+func (c *passwordCommand) StdinPipe() (io.WriteCloser, error) {
+	pipe, e := c.ExecCommand.StdinPipe()
+	if e != nil {
+		return nil, e
+	}
+	c.pipe = pipe
+	return pipe, nil
+}
+
+func (c *passwordCommand) Start() error {
+	if !c.stdinSet && c.pipe == nil {
+		c.ExecCommand.SetStdin(c.prompt())
+	}
+	if e := c.ExecCommand.Start(); e != nil || c.pipe == nil {
+		return e
+	}
+	_, e := io.Copy(c.pipe, c.prompt())
+	return e
+}
+
+func (c *passwordCommand) Run() error {
+	if e := c.Start(); e != nil {
+		return e
+	}
+	return c.Wait()
+}
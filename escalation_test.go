@@ -0,0 +1,99 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscalate(t *testing.T) {
+	for _, tc := range []struct {
+		user       string
+		escalation Escalation
+		become     string
+		expected   string
+	}{
+		{"root", EscalationDefault, "", "sh /x.sh"},
+		{"ubuntu", EscalationDefault, "", "sudo sh /x.sh"},
+		{"root", EscalationDefault, "app", "sudo -u app sh /x.sh"},
+		{"ubuntu", EscalationNone, "", "sh /x.sh"},
+		{"ubuntu", EscalationSudo, "app", "sudo -u app sh /x.sh"},
+		{"ubuntu", EscalationSudoPassword, "", `sudo -k -S -p '' sh -c 'sh /x.sh'`},
+		{"ubuntu", EscalationDoas, "", "doas -n sh /x.sh"},
+		{"root", EscalationSu, "app", `su -s /bin/sh -c 'sh /x.sh' app`},
+		{"root", EscalationSu, "", `su -s /bin/sh -c 'sh /x.sh' root`},
+	} {
+		b := &Build{Target: &fakeTarget{user: tc.user}, Escalation: tc.escalation, BecomeUser: tc.become, EscalationPassword: "pw"}
+		if c, e := b.escalate("sh /x.sh", tc.become); e != nil {
+			t.Errorf("didn't expect an error, got %q", e)
+		} else if c != tc.expected {
+			t.Errorf("expected %q for %s/%q, got %q", tc.expected, tc.user, tc.escalation, c)
+		}
+	}
+
+	if c, _ := (&Build{Target: &fakeTarget{}, Escalation: EscalationSu}).escalate("echo 'a'", ""); c != `su -s /bin/sh -c 'echo '\''a'\''' root` {
+		t.Errorf("expected command to be quoted, got %q", c)
+	}
+
+	for _, b := range []*Build{
+		{Target: &fakeTarget{}, Escalation: EscalationSudoPassword},
+		{Target: &fakeTarget{}, Escalation: EscalationNone, BecomeUser: "app"},
+		{Target: &fakeTarget{}, Escalation: "pkexec"},
+		{Target: &fakeTarget{}, BecomeUser: "app; reboot"},
+	} {
+		if _, e := b.escalate("true", ""); e == nil {
+			t.Errorf("expected an error for %q", b.Escalation)
+		}
+	}
+}
+
+func TestBuildBecomeUser(t *testing.T) {
+	ft := &fakeTarget{name: "host", user: "ubuntu"}
+	tpl := TemplateFunc(func(pkg Package) { pkg.AddCommands("base", Shell("echo base")) })
+	if e := (&Build{Target: ft, Template: tpl, BecomeUser: "app"}).Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+
+	// Only the template's commands are run as the become user.
+	for _, cmd := range ft.commands {
+		if strings.HasPrefix(cmd, "cat - > ") {
+			continue // log writers don't escalate
+		}
+		if strings.HasSuffix(cmd, ".sh") {
+			if !strings.HasPrefix(cmd, "sudo -u app sh ") {
+				t.Errorf("expected script to be run as become user, got %q", cmd)
+			}
+		} else if !strings.HasPrefix(cmd, "sudo ") || strings.Contains(cmd, "-u app") {
+			t.Errorf("expected internal command to be run as root, got %q", cmd)
+		}
+	}
+}
+
+func TestBuildSudoPassword(t *testing.T) {
+	c := &inputCommand{Command: Shell("cat > /tmp/file"), content: "content"}
+	ft := &fakeTarget{name: "host", user: "ubuntu"}
+	b := &Build{
+		Target:             ft,
+		Template:           TemplateFunc(func(pkg Package) { pkg.AddCommands("file", c) }),
+		Escalation:         EscalationSudoPassword,
+		EscalationPassword: "secret",
+	}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+
+	for _, cmd := range ft.commands {
+		if strings.HasPrefix(cmd, "cat - > ") {
+			continue // log writers don't escalate
+		}
+		if !strings.HasPrefix(cmd, "sudo -k -S -p '' sh -c ") {
+			t.Errorf("expected command to be escalated, got %q", cmd)
+		}
+		expected := "secret\n"
+		if strings.HasSuffix(cmd, ".sh'") {
+			expected += "content"
+		}
+		if in := ft.inputs[cmd]; in != expected {
+			t.Errorf("expected input %q for %q, got %q", expected, cmd, in)
+		}
+	}
+}
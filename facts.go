@@ -0,0 +1,259 @@
+package urknall
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Facts describe a target. They are gathered when first used while rendering
+// the build's template, i.e. not at all if no template uses them. Rendering is
+// aborted for that and started over afterwards, so templates are rendered
+// twice by builds gathering the facts. Templates with a field named Facts (of
+// type Facts or *Facts) are rendered from a copy with that field set, so that
+// the facts can be used in commands and task names like `{{ .Facts.OS }}`.
+// They are also available using TargetFacts.
+type Facts struct {
+	Hostname       string   // Hostname of the target.
+	OS             string   // ID from /etc/os-release (e.g. "ubuntu").
+	OSVersion      string   // VERSION_ID from /etc/os-release (e.g. "22.04").
+	Kernel         string   // Kernel release (e.g. "5.15.0-91-generic").
+	Arch           string   // Machine hardware name (e.g. "x86_64").
+	CPUs           int      // Number of online CPUs.
+	MemoryMB       int      // Total memory in megabytes.
+	InitSystem     string   // One of "systemd", "upstart", "openrc" and "sysvinit".
+	PackageManager string   // One of "apt", "dnf", "yum", "apk", "zypper" and "pacman" (empty if unknown).
+	IPAddresses    []string // Addresses of all interfaces, except loopback.
+}
+
+// The script used to gather the facts. It prints one "key=value" pair per line.
+const factsScript = `[ -f /etc/os-release ] && . /etc/os-release
+echo "os=${ID:-}"
+echo "os_version=${VERSION_ID:-}"
+echo "hostname=$(hostname)"
+echo "kernel=$(uname -r)"
+echo "arch=$(uname -m)"
+echo "cpus=$(getconf _NPROCESSORS_ONLN 2>/dev/null || nproc 2>/dev/null || echo 0)"
+echo "memory_kb=$(awk '/^MemTotal:/ { print $2 }' /proc/meminfo 2>/dev/null || echo 0)"
+if [ -d /run/systemd/system ]; then
+  echo "init=systemd"
+elif initctl version 2>/dev/null | grep -q upstart; then
+  echo "init=upstart"
+elif [ -x /sbin/openrc ] || [ -x /sbin/openrc-run ]; then
+  echo "init=openrc"
+else
+  echo "init=sysvinit"
+fi
+for pm in apt-get dnf yum apk zypper pacman; do
+  if command -v $pm > /dev/null 2>&1; then echo "package_manager=$pm"; break; fi
+done
+for ip in $(hostname -I 2>/dev/null || true); do echo "ip=$ip"; done`
+
+// gatherFacts returns the facts of the build's target. These are either set
+// explicitly, taken from the build's facts cache or probed on the target.
+func (build *Build) gatherFacts() (*Facts, error) {
+	if build.Facts != nil {
+		return build.Facts, nil
+	}
+	if facts := build.FactsCache.get(build.hostname()); facts != nil {
+		return facts, nil
+	}
+
+	c, e := build.prepareInternalCommand(factsScript)
+	if e != nil {
+		return nil, e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return nil, fmt.Errorf("failed to gather facts: %s err=%q", e, err.String())
+	}
+	facts := parseFacts(out.String())
+	build.FactsCache.set(build.hostname(), facts)
+	return facts, nil
+}
+
+func parseFacts(out string) *Facts {
+	facts := &Facts{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch key, value := kv[0], kv[1]; key {
+		case "os":
+			facts.OS = value
+		case "os_version":
+			facts.OSVersion = value
+		case "hostname":
+			facts.Hostname = value
+		case "kernel":
+			facts.Kernel = value
+		case "arch":
+			facts.Arch = value
+		case "cpus":
+			facts.CPUs, _ = strconv.Atoi(value)
+		case "memory_kb":
+			kb, _ := strconv.Atoi(value)
+			facts.MemoryMB = kb / 1024
+		case "init":
+			facts.InitSystem = value
+		case "package_manager":
+			facts.PackageManager = strings.TrimSuffix(value, "-get")
+		case "ip":
+			if !strings.HasPrefix(value, "127.") && value != "::1" {
+				facts.IPAddresses = append(facts.IPAddresses, value)
+			}
+		}
+	}
+	return facts
+}
+
+// TargetFacts returns the facts of the target the given package is built for
+// (nil if not known).
+func TargetFacts(pkg Package) *Facts {
+	if p, ok := pkg.(*packageImpl); ok {
+		return p.facts.get()
+	}
+	return nil
+}
+
+// targetFacts gathers the facts of a build's target when first used, so that
+// builds not using them don't have to.
+type targetFacts struct {
+	build *Build
+
+	mutex     sync.Mutex
+	rendering bool // Whether the template is rendered, i.e. the render mutex held.
+	gathered  bool
+	facts     *Facts
+	err       error
+}
+
+// get returns the facts, gathering them if required. While rendering, facts
+// not gathered yet abort rendering, so that they are gathered without holding
+// the render mutex (see renderTemplate). If gathering them failed rendering is
+// aborted too.
+func (tf *targetFacts) get() *Facts {
+	if tf == nil {
+		return nil
+	}
+	tf.mutex.Lock()
+	required := !tf.gathered && tf.rendering
+	tf.mutex.Unlock()
+	if required {
+		panic(factsError{})
+	}
+
+	tf.gather()
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.err != nil {
+		panic(factsError{err: tf.err})
+	}
+	return tf.facts
+}
+
+// gather gathers the facts, unless done before.
+func (tf *targetFacts) gather() {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if !tf.gathered {
+		tf.facts, tf.err = tf.build.gatherFacts()
+		tf.gathered = true
+	}
+}
+
+func (tf *targetFacts) setRendering(rendering bool) {
+	if tf == nil {
+		return
+	}
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.rendering = rendering
+}
+
+// Aborts rendering, if gathering the facts failed (or they are required, but
+// not gathered yet if err is nil).
+type factsError struct {
+	err error
+}
+
+// withFacts returns a copy of the template with the Facts field set, if it has
+// one, and the template itself otherwise.
+func withFacts(tpl Template, facts *targetFacts) Template {
+	v := reflect.ValueOf(tpl)
+	if facts == nil || v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return tpl
+	}
+	f, ok := v.Elem().Type().FieldByName("Facts")
+	if !ok || f.PkgPath != "" || len(f.Index) != 1 {
+		return tpl
+	}
+	var value reflect.Value
+	switch f.Type {
+	case reflect.TypeOf(&Facts{}):
+		value = reflect.ValueOf(facts.get())
+	case reflect.TypeOf(Facts{}):
+		value = reflect.ValueOf(*facts.get())
+	default:
+		return tpl
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	c.Elem().Field(f.Index[0]).Set(value)
+	return c.Interface().(Template)
+}
+
+// A facts cache keeps the facts of targets, so that builds sharing it gather
+// them only once per target. The zero value is ready to use.
+type FactsCache struct {
+	MaxAge time.Duration // Facts older than this are gathered again (kept forever if 0).
+
+	mutex   sync.Mutex
+	entries map[string]*factsCacheEntry
+}
+
+type factsCacheEntry struct {
+	facts    *Facts
+	gathered time.Time
+}
+
+// Remove the facts of the given target (identified by its address), so that
+// they are gathered again by the next build.
+func (c *FactsCache) Invalidate(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, host)
+}
+
+func (c *FactsCache) get(host string) *Facts {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[host]
+	if !ok || (c.MaxAge > 0 && time.Since(entry.gathered) > c.MaxAge) {
+		return nil
+	}
+	return entry.facts
+}
+
+func (c *FactsCache) set(host string, facts *Facts) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*factsCacheEntry{}
+	}
+	c.entries[host] = &factsCacheEntry{facts: facts, gathered: time.Now()}
+}
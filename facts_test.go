@@ -0,0 +1,177 @@
+package urknall
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megamsys/urknall/target"
+)
+
+const testFactsOutput = `os=ubuntu
+os_version=22.04
+hostname=web1
+kernel=5.15.0-91-generic
+arch=x86_64
+cpus=4
+memory_kb=8167940
+init=systemd
+package_manager=apt-get
+ip=10.0.0.5
+ip=127.0.0.1
+ip=fe80::1
+`
+
+type factsTemplate struct {
+	Facts *Facts
+}
+
+func (tpl *factsTemplate) Render(pkg Package) {
+	pkg.AddCommands("{{ .Facts.OS }}", &stringCommand{cmd: "echo {{ .Facts.PackageManager }}"})
+	pkg.AddCommands("func", Shell("echo "+TargetFacts(pkg).Arch))
+}
+
+func TestParseFacts(t *testing.T) {
+	facts := parseFacts(testFactsOutput)
+	expected := &Facts{
+		Hostname:       "web1",
+		OS:             "ubuntu",
+		OSVersion:      "22.04",
+		Kernel:         "5.15.0-91-generic",
+		Arch:           "x86_64",
+		CPUs:           4,
+		MemoryMB:       7976,
+		InitSystem:     "systemd",
+		PackageManager: "apt",
+		IPAddresses:    []string{"10.0.0.5", "fe80::1"},
+	}
+	if !reflect.DeepEqual(facts, expected) {
+		t.Errorf("expected facts %#v, got %#v", expected, facts)
+	}
+}
+
+func TestBuildFacts(t *testing.T) {
+	ft := &fakeTarget{name: "host", outputs: map[string]string{"os-release": testFactsOutput}}
+	b := &Build{Target: ft, Template: &factsTemplate{}}
+
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if plan.Tasks[0].Name != "ubuntu" {
+		t.Errorf("expected task name %q, got %q", "ubuntu", plan.Tasks[0].Name)
+	}
+	if script := plan.Tasks[0].Commands[0].Script; !strings.HasSuffix(script, "echo apt") {
+		t.Errorf("expected facts to be rendered into script, got %q", script)
+	}
+	if script := plan.Tasks[1].Commands[0].Script; !strings.HasSuffix(script, "echo x86_64") {
+		t.Errorf("expected facts to be available from package, got %q", script)
+	}
+}
+
+func TestBuildFactsOverride(t *testing.T) {
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: &factsTemplate{}, Facts: &Facts{OS: "debian"}}
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if plan.Tasks[0].Name != "debian" {
+		t.Errorf("expected task name %q, got %q", "debian", plan.Tasks[0].Name)
+	}
+	if cnt := countCommands(ft, "os-release"); cnt != 0 {
+		t.Errorf("expected facts not to be gathered, got %d probes", cnt)
+	}
+}
+
+func TestFactsCache(t *testing.T) {
+	ft := &fakeTarget{name: "host", outputs: map[string]string{"os-release": testFactsOutput}}
+	cache := &FactsCache{}
+	for i := 0; i < 2; i++ {
+		if _, e := (&Build{Target: ft, Template: &factsTemplate{}, FactsCache: cache}).Plan(); e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+	}
+	if cnt := countCommands(ft, "os-release"); cnt != 1 {
+		t.Errorf("expected facts to be gathered once, got %d", cnt)
+	}
+
+	cache.Invalidate("host")
+	if _, e := (&Build{Target: ft, Template: &factsTemplate{}, FactsCache: cache}).Plan(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "os-release"); cnt != 2 {
+		t.Errorf("expected facts to be gathered again, got %d", cnt)
+	}
+}
+
+func TestBuildFactsLazy(t *testing.T) {
+	// Facts are neither gathered nor required for templates not using them.
+	ft := &fakeTarget{name: "host", failing: "os-release"}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("base", Shell("echo base"))
+	})
+	if _, e := (&Build{Target: ft, Template: tpl}).Plan(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "os-release"); cnt != 0 {
+		t.Errorf("expected facts not to be gathered, got %d probes", cnt)
+	}
+
+	// Templates using them fail if they can't be gathered.
+	_, e := (&Build{Target: ft, Template: &factsTemplate{}}).Plan()
+	if e == nil || !strings.Contains(e.Error(), "failed to gather facts") {
+		t.Errorf("expected facts error, got %v", e)
+	}
+}
+
+func TestBuildFactsTemplateUnchanged(t *testing.T) {
+	ft := &fakeTarget{name: "host", outputs: map[string]string{"os-release": testFactsOutput}}
+	tpl := &factsTemplate{}
+	if _, e := (&Build{Target: ft, Template: tpl}).Plan(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if tpl.Facts != nil {
+		t.Errorf("expected template not to be modified, got facts %#v", tpl.Facts)
+	}
+}
+
+// probingTarget renders another template while the facts are probed.
+type probingTarget struct {
+	*fakeTarget
+	rendered chan error
+}
+
+func (pt *probingTarget) Command(c string) (target.ExecCommand, error) {
+	if strings.Contains(c, "os-release") {
+		go func() {
+			_, e := renderTemplate(TemplateFunc(fleetTemplate), nil)
+			pt.rendered <- e
+		}()
+		select {
+		case <-pt.rendered:
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("rendering blocked while probing the facts")
+		}
+	}
+	return pt.fakeTarget.Command(c)
+}
+
+func TestBuildFactsGatheredWithoutRenderLock(t *testing.T) {
+	ft := &fakeTarget{name: "host", outputs: map[string]string{"os-release": testFactsOutput}}
+	pt := &probingTarget{fakeTarget: ft, rendered: make(chan error, 1)}
+	plan, e := (&Build{Target: pt, Template: TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("arch", Shell("echo "+TargetFacts(pkg).Arch))
+	})}).Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if script := plan.Tasks[0].Commands[0].Script; !strings.Contains(script, "echo x86_64") {
+		t.Errorf("expected the facts to be used, got %q", script)
+	}
+	if cnt := countCommands(ft, "os-release"); cnt != 1 {
+		t.Errorf("expected facts to be gathered once, got %d probes", cnt)
+	}
+}
@@ -0,0 +1,241 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/megamsys/urknall/cmd"
+)
+
+// Handlers are tasks executed only if triggered by another task or command,
+// that was actually executed (i.e. not cached). A handler is executed at most
+// once, however often it was triggered, at the end of the build (see
+// FlushHandlers). Handlers are never cached.
+//
+// Triggered handlers are kept in the state store until executed (if it
+// implements HandlerStore, like the default store and the JSONStateStore
+// do), so that the handlers triggered by a failed build are executed by the
+// next one. Otherwise they are lost with the build, while the commands that
+// triggered them are cached.
+//
+// Handler names share the namespace of tasks. They are referenced (see
+// NotifyHandlers and cmd.Trigger) relative to the package the triggering task
+// is added to, like dependencies (see Dependent).
+//
+// AddHandler adds a handler with the given name and commands to the package.
+func AddHandler(pkg Package, name string, cmds ...cmd.Command) {
+	mustPackage(pkg).addHandler(name, cmds...)
+}
+
+// FlushHandlers has the handlers added to the package executed at this point
+// of the build (if triggered), i.e. after the tasks added before and before
+// those added later, instead of at the end. If called more than once, the last
+// call counts. Tasks added afterwards must not notify the package's handlers.
+func FlushHandlers(pkg Package) {
+	mustPackage(pkg).flushHandlers()
+}
+
+func mustPackage(pkg Package) *packageImpl {
+	p, ok := pkg.(*packageImpl)
+	if !ok {
+		panic(fmt.Sprintf("package of type %T doesn't support handlers", pkg))
+	}
+	return p
+}
+
+// expandHandlers resolves the handlers notified by each command and replaces
+// the flush markers with the handlers of the template that flushed them. Each
+// handler is executed once: at the last flush of the template it was added to
+// or, if there is none, at the end. Handlers are executed after all tasks
+// added before and before all tasks added after them, so the latter must not
+// notify them.
+func (pkg *packageImpl) expandHandlers() error {
+	for _, t := range pkg.tasks {
+		if t.flush {
+			continue
+		}
+		for _, c := range t.commands {
+			names := t.notifies
+			if tr, ok := c.command.(cmd.Trigger); ok {
+				names = append(append([]string{}, names...), tr.Triggers()...)
+			}
+			c.triggers = nil
+			for _, name := range names {
+				h := pkg.lookupHandler(t.scope, name)
+				if h == "" {
+					return fmt.Errorf("task %q notifies unknown handler %q", t.name, name)
+				}
+				c.triggers = append(c.triggers, h)
+			}
+		}
+	}
+
+	lastFlush := map[string]*task{}
+	for _, t := range pkg.tasks {
+		if t.flush {
+			lastFlush[t.scope] = t
+		}
+	}
+
+	tasks := []*task{}
+	var flushed []*task
+	executed := map[string]bool{}
+	flush := func(marker *task) {
+		for _, h := range pkg.handlers {
+			if lastFlush[h.scope] != marker {
+				continue
+			}
+			executed[h.name] = true
+			flushed = append(flushed, &task{
+				name:         h.name,
+				commands:     h.commands,
+				env:          h.env,
+				scope:        h.scope,
+				handler:      true,
+				implicitDeps: append([]*task{}, tasks...),
+			})
+			tasks = append(tasks, flushed[len(flushed)-1])
+		}
+	}
+	for _, t := range pkg.tasks {
+		if t.flush {
+			if lastFlush[t.scope] == t {
+				flush(t)
+			}
+			continue
+		}
+		for _, c := range t.commands {
+			for _, h := range c.triggers {
+				if executed[h] {
+					return fmt.Errorf("task %q notifies handler %q, that was flushed before", t.name, h)
+				}
+			}
+		}
+		t.implicitDeps = append([]*task{}, flushed...)
+		tasks = append(tasks, t)
+	}
+	flush(nil)
+	pkg.tasks = tasks
+	return nil
+}
+
+// lookupHandler returns the full name of the handler with the given name,
+// resolved relative to the given scope (empty if there is no such handler).
+func (pkg *packageImpl) lookupHandler(scope, name string) string {
+	for {
+		full := name
+		if scope != "" {
+			full = scope + "." + name
+		}
+		for _, h := range pkg.handlers {
+			if h.name == full {
+				return full
+			}
+		}
+		if scope == "" {
+			return ""
+		}
+		if i := strings.LastIndex(scope, "."); i != -1 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+// State stores implementing the HandlerStore interface keep the handlers that
+// were triggered, but not executed yet (see AddHandler).
+type HandlerStore interface {
+	// Return the handlers triggered by previous builds and not executed yet.
+	PendingHandlers(b *Build) ([]string, error)
+
+	// Replace the handlers pending.
+	SetPendingHandlers(b *Build, names []string) error
+}
+
+// The handlers triggered, but not executed yet.
+type handlerState struct {
+	build *Build
+	store HandlerStore // keeps the triggered handlers (if set)
+
+	mutex     sync.Mutex
+	triggered map[string]bool
+}
+
+// loadHandlers returns the handlers pending from previous builds, that are
+// handlers of the given tasks. If persist is set, changes are written to the
+// build's state store (if it is a HandlerStore).
+func (build *Build) loadHandlers(tasks []*task, persist bool) (*handlerState, error) {
+	s := &handlerState{build: build, triggered: map[string]bool{}}
+	handlers := map[string]bool{}
+	for _, t := range tasks {
+		if t.handler {
+			handlers[t.name] = true
+		}
+	}
+	store, ok := build.state().(HandlerStore)
+	if !ok || len(handlers) == 0 {
+		return s, nil
+	}
+	if persist {
+		s.store = store
+	}
+	pending, e := store.PendingHandlers(build)
+	if e != nil {
+		return nil, e
+	}
+	for _, name := range pending {
+		if handlers[name] {
+			s.triggered[name] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *handlerState) trigger(names []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for _, name := range names {
+		if !s.triggered[name] {
+			s.triggered[name] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// isTriggered returns whether the handler was triggered.
+func (s *handlerState) isTriggered(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.triggered[name]
+}
+
+// executed resets the handler after it was executed.
+func (s *handlerState) executed(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.triggered, name)
+	return s.save()
+}
+
+func (s *handlerState) save() error {
+	if s.store == nil {
+		return nil
+	}
+	names := make([]string, 0, len(s.triggered))
+	for name := range s.triggered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if e := s.store.SetPendingHandlers(s.build, names); e != nil {
+		return fmt.Errorf("failed to keep triggered handlers: %s", e)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/megamsys/urknall/cmd"
+)
+
+type triggerCommand struct {
+	cmd.Command
+	handlers []string
+}
+
+func (c *triggerCommand) Triggers() []string {
+	return c.handlers
+}
+
+type nginxTemplate struct{}
+
+func (tpl *nginxTemplate) Render(pkg Package) {
+	AddHandler(pkg, "restart", Shell("service nginx restart"))
+	pkg.AddTask("config", NotifyHandlers(NewTask().Add(Shell("echo config > /etc/nginx.conf")), "restart"))
+	pkg.AddTask("site", NotifyHandlers(NewTask().Add(Shell("echo site > /etc/site.conf")), "restart", "reload"))
+	FlushHandlers(pkg)
+}
+
+func handlerTemplate(pkg Package) {
+	AddHandler(pkg, "reload", Shell("echo reload"))
+	pkg.AddTemplate("nginx", &nginxTemplate{})
+	pkg.AddCommands("app", &triggerCommand{Command: Shell("echo app"), handlers: []string{"reload"}})
+}
+
+func TestExpandHandlers(t *testing.T) {
+	pkg, e := renderTemplate(TemplateFunc(handlerTemplate), nil)
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	expected := []string{"nginx.config", "nginx.site", "nginx.restart", "app", "reload"}
+	if names := taskNames(pkg); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected tasks %v, got %v", expected, names)
+	}
+
+	triggers := pkg.tasks[1].commands[0].triggers
+	if !reflect.DeepEqual(triggers, []string{"nginx.restart", "reload"}) {
+		t.Errorf("unexpected triggers %v", triggers)
+	}
+	if triggers := pkg.tasks[3].commands[0].triggers; !reflect.DeepEqual(triggers, []string{"reload"}) {
+		t.Errorf("unexpected triggers %v", triggers)
+	}
+
+	_, e = renderTemplate(TemplateFunc(func(pkg Package) {
+		pkg.AddTask("a", NotifyHandlers(NewTask().Add(Shell("echo a")), "missing"))
+	}), nil)
+	if e == nil || !strings.Contains(e.Error(), `unknown handler "missing"`) {
+		t.Errorf("expected unknown handler error, got %v", e)
+	}
+
+	// Handlers are executed once, at the last flush of their template.
+	pkg, e = renderTemplate(TemplateFunc(func(pkg Package) {
+		AddHandler(pkg, "restart", Shell("echo restart"))
+		pkg.AddTask("a", NotifyHandlers(NewTask().Add(Shell("echo a")), "restart"))
+		FlushHandlers(pkg)
+		pkg.AddTask("b", NotifyHandlers(NewTask().Add(Shell("echo b")), "restart"))
+		FlushHandlers(pkg)
+		pkg.AddCommands("c", Shell("echo c"))
+	}), nil)
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	expected = []string{"a", "b", "restart", "c"}
+	if names := taskNames(pkg); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected tasks %v, got %v", expected, names)
+	}
+
+	_, e = renderTemplate(TemplateFunc(func(pkg Package) {
+		AddHandler(pkg, "restart", Shell("echo restart"))
+		FlushHandlers(pkg)
+		pkg.AddTask("a", NotifyHandlers(NewTask().Add(Shell("echo a")), "restart"))
+	}), nil)
+	if e == nil || !strings.Contains(e.Error(), `handler "restart", that was flushed before`) {
+		t.Errorf("expected flushed handler error, got %v", e)
+	}
+}
+
+func TestBuildHandlers(t *testing.T) {
+	config, _ := commandChecksum(Shell("echo config > /etc/nginx.conf"))
+	site, _ := commandChecksum(Shell("echo site > /etc/site.conf"))
+	restart, _ := commandChecksum(Shell("service nginx restart"))
+	reload, _ := commandChecksum(Shell("echo reload"))
+
+	// Only the site config and app are executed, config is cached.
+	ft := &fakeTarget{
+		name:    "host",
+		outputs: map[string]string{"*.run": ukCACHEDIR + "/nginx.config/" + config + ".done\n"},
+	}
+	b := &Build{Target: ft, Template: TemplateFunc(handlerTemplate)}
+
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	triggered := []bool{}
+	for _, tp := range plan.Tasks {
+		if tp.Handler {
+			triggered = append(triggered, tp.Triggered)
+		}
+	}
+	if expected := []bool{true, true}; !reflect.DeepEqual(triggered, expected) {
+		t.Errorf("expected handlers triggered %v, got %v", expected, triggered)
+	}
+
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "sh "+ukCACHEDIR+"/nginx.site/"+site+".sh"); cnt != 1 {
+		t.Errorf("expected site config to be executed once, got %d", cnt)
+	}
+	if cnt := countCommands(ft, "sh "+ukCACHEDIR+"/nginx.restart/"+restart+".sh"); cnt != 1 {
+		t.Errorf("expected restart handler to be executed once, got %d", cnt)
+	}
+	if cnt := countCommands(ft, "sh "+ukCACHEDIR+"/reload/"+reload+".sh"); cnt != 1 {
+		t.Errorf("expected reload handler to be executed once, got %d", cnt)
+	}
+}
+
+func TestBuildHandlersPending(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	tpl := TemplateFunc(func(pkg Package) {
+		AddHandler(pkg, "restart", Shell("echo restart"))
+		pkg.AddTask("config", NotifyHandlers(NewTask().Add(Shell("echo config")), "restart"))
+		pkg.AddCommands("app", Shell("echo app"))
+	})
+	config, _ := commandChecksum(Shell("echo config"))
+	app, _ := commandChecksum(Shell("echo app"))
+	restart, _ := commandChecksum(Shell("echo restart"))
+	store := NewJSONStateStore(filepath.Join(dir, "state.json"))
+
+	// The build fails after the config was changed, before the handler is
+	// executed.
+	ft := &fakeTarget{name: "host", failing: "urknall.fake/" + app + ".sh"}
+	if e := (&Build{Target: ft, Template: tpl, State: store}).Run(); e == nil {
+		t.Fatalf("expected the build to fail")
+	}
+	if cnt := countCommands(ft, "urknall.fake/"+restart+".sh"); cnt != 0 {
+		t.Errorf("expected restart handler not to be executed, got %d", cnt)
+	}
+
+	// The next build executes it, although the config is cached.
+	ft = &fakeTarget{name: "host"}
+	if e := (&Build{Target: ft, Template: tpl, State: store}).Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "urknall.fake/"+config+".sh"); cnt != 0 {
+		t.Errorf("expected config to be cached, got %d executions", cnt)
+	}
+	if cnt := countCommands(ft, "urknall.fake/"+restart+".sh"); cnt != 1 {
+		t.Errorf("expected restart handler to be executed once, got %d", cnt)
+	}
+	if pending, _ := store.PendingHandlers(&Build{Target: ft}); len(pending) != 0 {
+		t.Errorf("expected no pending handlers, got %v", pending)
+	}
+}
+
+func TestTargetStateStorePendingHandlers(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	local, _ := NewLocalTarget()
+	store := &targetStateStore{}
+	b := &Build{Target: shellTarget{local}, CacheDir: dir}
+
+	for _, names := range [][]string{{"nginx.restart", "it's reload"}, {}} {
+		if e := store.SetPendingHandlers(b, names); e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+		pending, e := store.PendingHandlers(b)
+		if e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+		if !reflect.DeepEqual(pending, names) {
+			t.Errorf("expected pending handlers %v, got %v", names, pending)
+		}
+	}
+}
@@ -66,7 +66,7 @@ func rcover(t *testing.T) {
 
 func TestIntegration(t *testing.T) {
 	bh := &BuildHost{}
-	p, e := renderTemplate(bh)
+	p, e := renderTemplate(bh, nil)
 	if e != nil {
 		t.Errorf("didn't expect an error")
 	}
@@ -0,0 +1,72 @@
+package urknall
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/megamsys/urknall/pubsub"
+)
+
+// invalidationIndex returns the index of the first command of the given task,
+// that must be executed regardless of the cache (-1 if there is none). See the
+// build's Invalidate, InvalidateFrom and AlwaysRun options.
+func (build *Build) invalidationIndex(name string) (int, error) {
+	index := -1
+	invalidate := func(pattern string, from int) error {
+		matched, e := path.Match(pattern, name)
+		if e != nil {
+			return fmt.Errorf("invalid task pattern %q: %s", pattern, e)
+		}
+		if matched && (index == -1 || from < index) {
+			index = from
+		}
+		return nil
+	}
+
+	for _, patterns := range [][]string{build.AlwaysRun, build.Invalidate} {
+		for _, pattern := range patterns {
+			if e := invalidate(pattern, 0); e != nil {
+				return -1, e
+			}
+		}
+	}
+	for pattern, from := range build.InvalidateFrom {
+		if from < 0 {
+			return -1, fmt.Errorf("invalid command index %d for task pattern %q", from, pattern)
+		}
+		if e := invalidate(pattern, from); e != nil {
+			return -1, e
+		}
+	}
+	return index, nil
+}
+
+// invalidate marks the cached commands of the task starting at the given
+// index as invalidated, i.e. they will be executed.
+func (tsk *task) invalidate(index int) {
+	for i := index; index >= 0 && i < len(tsk.commands); i++ {
+		if tsk.commands[i].cached {
+			tsk.commands[i].cached = false
+			tsk.commands[i].invalidated = true
+		}
+	}
+}
+
+// publishInvalidations publishes the invalidated cache entries of the given
+// tasks, if there are any.
+func (build *Build) publishInvalidations(tasks []*task) {
+	entries := []string{}
+	for _, tsk := range tasks {
+		for _, c := range tsk.commands {
+			if c.invalidated {
+				entries = append(entries, tsk.name+"/"+c.Checksum())
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+	m := message(pubsub.MessageCleanupCacheEntries, build.hostname(), "")
+	m.InvalidatedCacheEntries = entries
+	m.Publish("invalidated")
+}
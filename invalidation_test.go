@@ -0,0 +1,60 @@
+package urknall
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildInvalidation(t *testing.T) {
+	first, _ := commandChecksum(Shell("echo first"))
+	second, _ := commandChecksum(Shell("echo second"))
+	run := ukCACHEDIR + "/base/" + first + ".done\n" + ukCACHEDIR + "/base/" + second + ".done\n"
+
+	data := []struct {
+		build       Build
+		cached      []bool
+		invalidated []bool
+	}{
+		{Build{}, []bool{true, true}, []bool{false, false}},
+		{Build{Invalidate: []string{"ba*"}}, []bool{false, false}, []bool{true, true}},
+		{Build{Invalidate: []string{"other"}}, []bool{true, true}, []bool{false, false}},
+		{Build{InvalidateFrom: map[string]int{"base": 1}}, []bool{true, false}, []bool{false, true}},
+		{Build{InvalidateFrom: map[string]int{"base": 1, "*": 0}}, []bool{false, false}, []bool{true, true}},
+		{Build{AlwaysRun: []string{"base"}}, []bool{false, false}, []bool{true, true}},
+	}
+
+	for i, d := range data {
+		b := d.build
+		b.Target = &fakeTarget{name: "host", outputs: map[string]string{"*.run": run}}
+		b.Template = TemplateFunc(planTemplate)
+
+		plan, e := b.Plan()
+		if e != nil {
+			t.Fatalf("%d: didn't expect an error, got %q", i, e)
+		}
+		cached, invalidated := []bool{}, []bool{}
+		for _, c := range plan.Tasks[0].Commands {
+			cached = append(cached, c.Cached)
+			invalidated = append(invalidated, c.Invalidated)
+		}
+		if !reflect.DeepEqual(cached, d.cached) {
+			t.Errorf("%d: expected cached %v, got %v", i, d.cached, cached)
+		}
+		if !reflect.DeepEqual(invalidated, d.invalidated) {
+			t.Errorf("%d: expected invalidated %v, got %v", i, d.invalidated, invalidated)
+		}
+	}
+}
+
+func TestBuildInvalidationErrors(t *testing.T) {
+	for i, b := range []*Build{
+		{Invalidate: []string{"["}},
+		{InvalidateFrom: map[string]int{"base": -1}},
+	} {
+		b.Target = &fakeTarget{name: "host"}
+		b.Template = TemplateFunc(planTemplate)
+		if _, e := b.Plan(); e == nil {
+			t.Errorf("%d: expected an error, got none", i)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package urknall
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megamsys/urknall/target"
+)
+
+// State stores implementing the Locker interface are locked for the duration
+// of a build, so that concurrent builds on the same target can't corrupt the
+// cache.
+type Locker interface {
+	// Acquire the lock, waiting at most the given timeout for a lock held by
+	// another build. The returned function releases the lock. The returned
+	// channel is closed if the lock is lost before it is released, e.g. with
+	// the target's connection; it is nil if the lock can't be lost.
+	Lock(b *Build, timeout time.Duration) (unlock func() error, lost <-chan struct{}, e error)
+
+	// Return information on the current lock (nil if there is none).
+	LockInfo(b *Build) (*LockInfo, error)
+
+	// Forcefully release a lock held by another build.
+	BreakLock(b *Build) error
+}
+
+// Information on the build holding a target's lock.
+type LockInfo struct {
+	Owner     string    // User running the build holding the lock.
+	Hostname  string    // Host the build is running on.
+	PID       int       // Process ID of the build.
+	RemotePID int       // Process ID on the target holding the lock.
+	Since     time.Time // When the lock was acquired.
+	Held      bool      // Whether the lock is still held. A lock not held is stale.
+}
+
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d) since %s", info.Owner, info.Hostname, info.PID, info.Since.Format(time.RFC3339))
+}
+
+// The error returned if a target is locked by another build.
+type LockedError struct {
+	Info *LockInfo // Information on the lock's holder (nil if not available).
+}
+
+func (e *LockedError) Error() string {
+	if e.Info == nil {
+		return "target is locked by another build"
+	}
+	return "target is locked by " + e.Info.String()
+}
+
+// LockInfo returns information about the build currently holding the lock on
+// the target (nil if there is none).
+func (b *Build) LockInfo() (*LockInfo, error) {
+	locker, ok := b.state().(Locker)
+	if !ok {
+		return nil, fmt.Errorf("state store %T doesn't support locking", b.state())
+	}
+	return locker.LockInfo(b)
+}
+
+// BreakLock forcefully releases the lock held by another build on the target.
+// Use with care, for example if the build holding the lock crashed without
+// its connection being closed.
+func (b *Build) BreakLock() error {
+	locker, ok := b.state().(Locker)
+	if !ok {
+		return fmt.Errorf("state store %T doesn't support locking", b.state())
+	}
+	return locker.BreakLock(b)
+}
+
+// Reset the target's connection. A lock held by the build is acquired again
+// afterwards, as it might be bound to the connection (like the default state
+// store's is).
+func (b *Build) Reset() error {
+	e := b.Target.Reset()
+	if b.held == nil {
+		return e
+	}
+	if err := b.held.renew(); err != nil {
+		return err
+	}
+	return e
+}
+
+func (b *Build) lock() error {
+	locker, ok := b.state().(Locker)
+	if !ok || b.DisableLock {
+		return nil
+	}
+	held := &heldLock{build: b, locker: locker}
+	if e := held.renew(); e != nil {
+		return e
+	}
+	b.held = held
+	return nil
+}
+
+func (b *Build) releaseLock() {
+	if b.held == nil {
+		return
+	}
+	if e := b.held.release(); e != nil {
+		logError(fmt.Errorf("failed to release lock: %s", e))
+	}
+	b.held = nil
+}
+
+// A lock held by a build.
+type heldLock struct {
+	build  *Build
+	locker Locker
+
+	mutex  sync.Mutex // Guards unlock and lost, as the target might be reset by concurrent tasks.
+	unlock func() error
+	lost   <-chan struct{}
+}
+
+// renew (re)acquires the lock.
+func (l *heldLock) renew() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.acquire()
+}
+
+// ensure acquires the lock again if it was lost, e.g. as the target's
+// connection was replaced transparently.
+func (l *heldLock) ensure() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.lost:
+		return l.acquire()
+	default:
+		return nil
+	}
+}
+
+// acquire releases the previous lock, ignoring errors as it is usually gone
+// with the target's connection, and acquires the lock.
+func (l *heldLock) acquire() error {
+	if l.unlock != nil {
+		_ = l.unlock()
+		l.unlock, l.lost = nil, nil
+	}
+	unlock, lost, e := l.locker.Lock(l.build, l.build.LockTimeout)
+	if e != nil {
+		return e
+	}
+	l.unlock, l.lost = unlock, lost
+	return nil
+}
+
+func (l *heldLock) release() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.unlock == nil {
+		return nil
+	}
+	e := l.unlock()
+	l.unlock, l.lost = nil, nil
+	return e
+}
+
+var lockInfoValue = regexp.MustCompile(`[^a-zA-Z0-9._@:+-]`)
+
+// Exit status of the lock command if flock isn't installed on the target.
+const flockMissing = 127
+
+// The lock is held by a flock process on the target, that runs until the
+// command's standard input is closed (or the connection dropped, which loses
+// the lock). The lock is acquired before the cache is prepared, so the cache
+// directory is created if missing.
+func (s *targetStateStore) Lock(build *Build, timeout time.Duration) (func() error, <-chan struct{}, error) {
+	cacheDir := build.cacheDir()
+	lockFile, infoFile := cacheDir+"/.lock", cacheDir+"/.lock.info"
+
+	wait := "-n"
+	if timeout > 0 {
+		wait = fmt.Sprintf("-w %d", int(timeout.Seconds()+0.5))
+	}
+	info := fmt.Sprintf("owner=%s host=%s pid=%d since=%s",
+		lockInfoValue.ReplaceAllString(currentUser(), "_"),
+		lockInfoValue.ReplaceAllString(currentHostname(), "_"),
+		os.Getpid(), time.Now().Format(time.RFC3339))
+	rawCmd := fmt.Sprintf(`flock %s %s sh -c 'echo "%s remote_pid=$$" > %s && echo locked && cat > /dev/null; rm -f %[4]s'`,
+		wait, lockFile, info, infoFile)
+	rawCmd = "sh -c " + shellQuote(fmt.Sprintf("command -v flock > /dev/null || exit %d; mkdir -p %s && exec %s", flockMissing, cacheDir, rawCmd))
+
+	c, e := build.prepareCommand(rawCmd)
+	if e != nil {
+		return nil, nil, e
+	}
+	in, e := c.StdinPipe()
+	if e != nil {
+		return nil, nil, e
+	}
+	out, e := c.StdoutPipe()
+	if e != nil {
+		return nil, nil, e
+	}
+	err := &bytes.Buffer{}
+	c.SetStderr(err)
+	if e := c.Start(); e != nil {
+		return nil, nil, e
+	}
+
+	if line, _ := bufio.NewReader(out).ReadString('\n'); line != "locked\n" {
+		in.Close()
+		waitErr := c.Wait()
+		holder, e := s.LockInfo(build)
+		if e != nil {
+			logError(e)
+		}
+		// flock exits with status 1 if the lock couldn't be acquired in time.
+		switch {
+		case isExitStatus(waitErr, flockMissing):
+			return nil, nil, fmt.Errorf("failed to acquire lock: flock not found on the target (install it or set Build.DisableLock)")
+		case isExitStatus(waitErr, 1) || (holder != nil && holder.Held):
+			return nil, nil, &LockedError{Info: holder}
+		}
+		return nil, nil, fmt.Errorf("failed to acquire lock: %v err=%q", waitErr, err.String())
+	}
+
+	// The command only finishes before the lock is released if it was lost.
+	lost := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = c.Wait()
+		close(lost)
+	}()
+	return func() error {
+		closeErr := in.Close()
+		<-lost
+		if waitErr != nil {
+			return waitErr
+		}
+		return closeErr
+	}, lost, nil
+}
+
+func (s *targetStateStore) LockInfo(build *Build) (*LockInfo, error) {
+	lockFile, infoFile := build.cacheDir()+"/.lock", build.cacheDir()+"/.lock.info"
+	rawCmd := fmt.Sprintf(`if [ -f %[2]s ]; then cat %[2]s; { flock -n %[1]s true && echo free; } || echo held; fi`, lockFile, infoFile)
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return nil, e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return nil, fmt.Errorf("failed to read lock info: %s err=%q", e, err.String())
+	}
+	return parseLockInfo(out.String()), nil
+}
+
+func (s *targetStateStore) BreakLock(build *Build) error {
+	info, e := s.LockInfo(build)
+	if e != nil || info == nil {
+		return e
+	}
+	rawCmd := "rm -f " + build.cacheDir() + "/.lock.info"
+	if info.Held && info.RemotePID > 0 {
+		// Kill the lock holding shell's children first, as they inherited the lock.
+		rawCmd = fmt.Sprintf("{ pkill -P %[1]d; kill %[1]d; true; } && %[2]s", info.RemotePID, rawCmd)
+	}
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return e
+	}
+	return c.Run()
+}
+
+func parseLockInfo(out string) *LockInfo {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return nil
+	}
+	info := &LockInfo{}
+	for _, field := range strings.Fields(out) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			info.Held = field == "held"
+			continue
+		}
+		switch kv[0] {
+		case "owner":
+			info.Owner = kv[1]
+		case "host":
+			info.Hostname = kv[1]
+		case "pid":
+			info.PID, _ = strconv.Atoi(kv[1])
+		case "remote_pid":
+			info.RemotePID, _ = strconv.Atoi(kv[1])
+		case "since":
+			info.Since, _ = time.Parse(time.RFC3339, kv[1])
+		}
+	}
+	return info
+}
+
+func isExitStatus(e error, status int) bool {
+	code, ok := target.ExitStatus(e)
+	return ok && code == status
+}
+
+func currentUser() string {
+	if u, e := user.Current(); e == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+func currentHostname() string {
+	h, _ := os.Hostname()
+	return h
+}
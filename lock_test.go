@@ -0,0 +1,151 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLockInfo = "owner=bob host=ci pid=42 since=2024-01-02T03:04:05Z remote_pid=1234"
+
+func countCommands(ft *fakeTarget, substr string) (cnt int) {
+	for _, c := range ft.commands {
+		if strings.Contains(c, substr) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// commandIndex returns the index of the first command containing the given
+// string (-1 if there is none).
+func commandIndex(ft *fakeTarget, substr string) int {
+	for i, c := range ft.commands {
+		if strings.Contains(c, substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestParseLockInfo(t *testing.T) {
+	if info := parseLockInfo("\n"); info != nil {
+		t.Errorf("expected no lock info, got %v", info)
+	}
+
+	info := parseLockInfo(testLockInfo + "\nheld\n")
+	if info == nil {
+		t.Fatal("expected lock info, got nil")
+	}
+	if info.Owner != "bob" || info.Hostname != "ci" || info.PID != 42 || info.RemotePID != 1234 {
+		t.Errorf("unexpected lock info %#v", info)
+	}
+	if expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !info.Since.Equal(expected) {
+		t.Errorf("expected lock to be held since %s, got %s", expected, info.Since)
+	}
+	if !info.Held {
+		t.Errorf("expected lock to be held")
+	}
+
+	if info := parseLockInfo(testLockInfo + "\nfree\n"); info.Held {
+		t.Errorf("expected stale lock not to be held")
+	}
+}
+
+func TestBuildLock(t *testing.T) {
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate), LockTimeout: 5 * time.Second}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "flock -w 5 /var/lib/urknall/.lock"); cnt != 1 {
+		t.Errorf("expected lock to be acquired once, got %d", cnt)
+	}
+	if b.held != nil {
+		t.Errorf("expected lock to be released")
+	}
+	if lock, prepare := commandIndex(ft, "flock"), commandIndex(ft, "/etc/group"); lock > prepare {
+		t.Errorf("expected lock to be acquired before the cache is prepared")
+	}
+
+	// Bootstrapping resets the connection, which releases the lock.
+	ft = &fakeTarget{name: "host", failing: "/etc/group | grep", failures: 1}
+	b = &Build{Target: ft, Template: TemplateFunc(fleetTemplate)}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "flock -n /var/lib/urknall/.lock"); cnt != 2 {
+		t.Errorf("expected lock to be acquired again after the reset, got %d", cnt)
+	}
+
+	ft = &fakeTarget{name: "host"}
+	b = &Build{Target: ft, Template: TemplateFunc(fleetTemplate), DisableLock: true}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "flock"); cnt != 0 {
+		t.Errorf("expected no lock to be acquired, got %d", cnt)
+	}
+}
+
+func TestBuildLockLost(t *testing.T) {
+	// The lock is lost with a connection replaced transparently, and acquired
+	// again before the template's commands are run.
+	ft := &fakeTarget{name: "host", lockLost: 1}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate)}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "flock -n /var/lib/urknall/.lock"); cnt != 2 {
+		t.Errorf("expected lock to be acquired again, got %d", cnt)
+	}
+	if b.held != nil {
+		t.Errorf("expected lock to be released")
+	}
+}
+
+func TestBuildLockWithoutFlock(t *testing.T) {
+	ft := &fakeTarget{name: "host", noFlock: true}
+	e := (&Build{Target: ft, Template: TemplateFunc(fleetTemplate)}).Run()
+	if e == nil || !strings.Contains(e.Error(), "flock not found") {
+		t.Fatalf("expected error on missing flock, got %v", e)
+	}
+	if cnt := countCommands(ft, "/etc/group"); cnt != 0 {
+		t.Errorf("expected cache not to be prepared, got %d commands", cnt)
+	}
+}
+
+func TestBuildLocked(t *testing.T) {
+	ft := &fakeTarget{name: "host", lockedBy: testLockInfo}
+	b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate)}
+
+	e := b.Run()
+	le, ok := e.(*LockedError)
+	if !ok {
+		t.Fatalf("expected a *LockedError, got %#v", e)
+	}
+	if le.Info == nil || le.Info.Owner != "bob" || !le.Info.Held {
+		t.Errorf("unexpected lock info %#v", le.Info)
+	}
+	if cnt := countCommands(ft, ".sh"); cnt != 0 {
+		t.Errorf("expected no command to be executed, got %d", cnt)
+	}
+
+	info, e := b.LockInfo()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if info == nil || info.RemotePID != 1234 {
+		t.Errorf("unexpected lock info %#v", info)
+	}
+
+	if e = b.BreakLock(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "pkill -P 1234; kill 1234"); cnt != 1 {
+		t.Errorf("expected lock holder to be killed once, got %d", cnt)
+	}
+	if e = b.Run(); e != nil {
+		t.Fatalf("didn't expect an error after breaking the lock, got %q", e)
+	}
+}
@@ -0,0 +1,98 @@
+// Megam Event Notifications
+//
+// This package sends the lifecycle events of urknall builds to the megam
+// event backend (see github.com/megamsys/libgo/events). Builds that should
+// report their status set a Notifier as the build's urknall.Notifier:
+//
+//	b := &urknall.Build{Target: target, Template: tpl, Notifier: &megam.Notifier{Inputs: inputs}}
+package megam
+
+import (
+	"time"
+
+	"github.com/megamsys/libgo/events"
+	"github.com/megamsys/libgo/events/alerts"
+	"github.com/megamsys/libgo/pairs"
+	constants "github.com/megamsys/libgo/utils/obc"
+	"github.com/megamsys/urknall"
+)
+
+const (
+	RUNNING   = "running"
+	FINISHED  = "finished"
+	STARTING  = "starting"
+	COMPLETED = "completed"
+)
+
+// A shortcut creating and running a build from the given target and template,
+// with events sent using the given inputs.
+func Run(target urknall.Target, tpl urknall.Template, inputs map[string]string) error {
+	return (&urknall.Build{Target: target, Template: tpl, Notifier: &Notifier{Inputs: inputs}}).Run()
+}
+
+// A shortcut creating and running a multi build from the given targets and
+// template, with events sent using the given inputs.
+func RunMulti(targets []urknall.Target, tpl urknall.Template, concurrency int, inputs map[string]string) error {
+	return (&urknall.MultiBuild{
+		Targets:     targets,
+		Build:       urknall.Build{Template: tpl, Notifier: &Notifier{Inputs: inputs}},
+		Concurrency: concurrency}).Run()
+}
+
+// The notifier writes a status event for the start and end of a build
+// ("<template>.running" and "<template>.finished") and of each executed task
+// ("<task>.starting" and "<task>.completed"). Failures aren't reported.
+type Notifier struct {
+	Inputs map[string]string // Inputs for OBC like email and host id.
+}
+
+func (n *Notifier) Notify(ev *urknall.Event) error {
+	var status string
+	switch ev.Type {
+	case urknall.EventBuildStarted:
+		status = ev.Template + "." + RUNNING
+	case urknall.EventBuildFinished:
+		status = ev.Template + "." + FINISHED
+	case urknall.EventTaskStarting:
+		status = ev.Task + "." + STARTING
+	case urknall.EventTaskCompleted:
+		status = ev.Task + "." + COMPLETED
+	default:
+		return nil
+	}
+	return n.write(ev.Host, constants.Status(status))
+}
+
+func (n *Notifier) write(host string, status constants.Status) error {
+	var email, hostid string
+	for k, v := range n.Inputs {
+		switch k {
+		case constants.USERMAIL:
+			email = v
+		case constants.HOST_ID:
+			hostid = v
+		}
+	}
+	mi := make(map[string]string)
+	js := make(pairs.JsonPairs, 0)
+	m := make(map[string][]string, 2)
+	m["status"] = []string{status.String()}
+	m["description"] = []string{status.Description(host)}
+	js.NukeAndSet(m) //just nuke the matching output key:
+
+	mi[constants.HOST_IP] = host
+	mi[constants.HOST_ID] = hostid
+	mi[constants.ACCOUNT_ID] = email
+	mi[constants.EVENT_TYPE] = status.Event_type()
+	newEvent := events.NewMulti(
+		[]*events.Event{
+			&events.Event{
+				AccountsId:  email,
+				EventAction: alerts.STATUS,
+				EventType:   constants.EventUser,
+				EventData:   alerts.EventData{M: mi, D: js.ToString()},
+				Timestamp:   time.Now().Local(),
+			},
+		})
+	return newEvent.Write()
+}
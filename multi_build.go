@@ -0,0 +1,103 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// A shortcut creating and running a multi build from the given targets and
+// template, provisioning at most concurrency targets at the same time.
+func RunMulti(targets []Target, tpl Template, concurrency int) error {
+	return (&MultiBuild{
+		Targets:     targets,
+		Build:       Build{Template: tpl},
+		Concurrency: concurrency}).Run()
+}
+
+// A multi build runs the same build on a list of targets. Each target gets its
+// own copy of the Build (i.e. the template is rendered once per host) and the
+// builds run concurrently, limited by the Concurrency setting.
+type MultiBuild struct {
+	Targets     []Target // Where to run the builds.
+	Build       Build    // Prototype of the per target builds. The Target field is ignored.
+	Concurrency int      // Maximum number of targets provisioned at the same time (no limit if <= 0).
+}
+
+// Run the build on all targets. Failing targets don't stop the build on the
+// other targets. If at least one target failed a MultiBuildError is returned.
+func (mb *MultiBuild) Run() error {
+	return mb.RunContext(context.Background())
+}
+
+// Like Run, but all builds are aborted if the given context is done.
+func (mb *MultiBuild) RunContext(ctx context.Context) error {
+	return mb.each(func(b *Build) error { return b.RunContext(ctx) })
+}
+
+// Run DryRun on all targets.
+func (mb *MultiBuild) DryRun() error {
+	return mb.each(func(b *Build) error { return b.DryRun() })
+}
+
+func (mb *MultiBuild) each(f func(b *Build) error) error {
+	limit := mb.Concurrency
+	if limit <= 0 || limit > len(mb.Targets) {
+		limit = len(mb.Targets)
+	}
+	slots := make(chan struct{}, limit)
+	errs := make([]error, len(mb.Targets))
+
+	var wg sync.WaitGroup
+	for i := range mb.Targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs[i] = f(mb.build(mb.Targets[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	var e MultiBuildError
+	for i := range errs {
+		if errs[i] != nil {
+			e = append(e, &TargetError{Hostname: (&Build{Target: mb.Targets[i]}).hostname(), Err: errs[i]})
+		}
+	}
+	if len(e) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (mb *MultiBuild) build(t Target) *Build {
+	b := mb.Build
+	b.Target = t
+	return &b
+}
+
+// The error of a single target's build in a multi build.
+type TargetError struct {
+	Hostname string // Hostname of the failed target.
+	Err      error  // Error the target's build returned.
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Hostname, e.Err.Error())
+}
+
+// The error returned by a multi build. It contains an entry for each target
+// the build failed on (in the order of the build's targets).
+type MultiBuildError []*TargetError
+
+func (e MultiBuildError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, te := range e {
+		msgs = append(msgs, te.Error())
+	}
+	return fmt.Sprintf("build failed on %d target(s): %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,332 @@
+package urknall
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megamsys/urknall/target"
+)
+
+// fakeTarget is a target that doesn't execute anything. It records all
+// commands and fails those that contain the configured failing string.
+type fakeTarget struct {
+	name     string
+	failing  string
+	failures int               // Number of times failing commands fail (always if 0).
+	failErr  error             // Error returned by failing commands.
+	delay    time.Duration     // Runtime of executed scripts.
+	slow     string            // Scripts containing it run for a minute instead.
+	outputs  map[string]string // Output written to stdout by commands containing the key.
+	lockedBy string            // Lock info of another build holding the target's lock.
+	noFlock  bool              // Whether flock is missing on the target.
+	lockLost int               // Number of times the lock is lost right after being acquired.
+	user     string            // User of the target (root if empty).
+	gauge    *runGauge         // Counts scripts running on any of the targets sharing it.
+
+	mutex    sync.Mutex
+	commands []string
+	inputs   map[string]string // Standard input read by the commands.
+	failed   int
+	running  int
+	maxRun   int
+}
+
+func (ft *fakeTarget) Command(c string) (target.ExecCommand, error) {
+	ft.mutex.Lock()
+	ft.commands = append(ft.commands, c)
+	ft.mutex.Unlock()
+	return &fakeCommand{target: ft, cmd: c}, nil
+}
+
+func (ft *fakeTarget) User() string {
+	if ft.user == "" {
+		return "root"
+	}
+	return ft.user
+}
+
+func (ft *fakeTarget) String() string { return ft.name }
+func (ft *fakeTarget) Reset() error   { return nil }
+
+// fail returns whether a failing command should fail, counting the failures.
+func (ft *fakeTarget) fail() bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.failed++
+	return ft.failures == 0 || ft.failed <= ft.failures
+}
+
+func (ft *fakeTarget) lockHolder() string {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	return ft.lockedBy
+}
+
+func (ft *fakeTarget) loseLock() bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	if ft.lockLost == 0 {
+		return false
+	}
+	ft.lockLost--
+	return true
+}
+
+func (ft *fakeTarget) enter() {
+	ft.gauge.enter()
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.running++
+	if ft.running > ft.maxRun {
+		ft.maxRun = ft.running
+	}
+}
+
+func (ft *fakeTarget) leave() {
+	ft.gauge.leave()
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	ft.running--
+}
+
+// runGauge records the peak number of scripts running at the same time.
+type runGauge struct {
+	mutex   sync.Mutex
+	running int
+	peak    int
+}
+
+func (g *runGauge) enter() {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.running++
+	if g.running > g.peak {
+		g.peak = g.running
+	}
+}
+
+func (g *runGauge) leave() {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.running--
+}
+
+var mktempDir = regexp.MustCompile(`mktemp -d '([^']*)'/urknall\.X+`)
+
+type fakeCommand struct {
+	target *fakeTarget
+	cmd    string
+
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	closers        []io.Closer
+	done           chan error
+	interrupted    chan struct{}
+}
+
+func (fc *fakeCommand) StdoutPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	fc.stdout = w
+	fc.closers = append(fc.closers, w)
+	return r, nil
+}
+
+func (fc *fakeCommand) StderrPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	fc.stderr = w
+	fc.closers = append(fc.closers, w)
+	return r, nil
+}
+
+func (fc *fakeCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	fc.stdin = r
+	return w, nil
+}
+
+func (fc *fakeCommand) SetStdout(w io.Writer) { fc.stdout = w }
+func (fc *fakeCommand) SetStderr(w io.Writer) { fc.stderr = w }
+func (fc *fakeCommand) SetStdin(r io.Reader)  { fc.stdin = r }
+
+func (fc *fakeCommand) Run() error {
+	if e := fc.Start(); e != nil {
+		return e
+	}
+	return fc.Wait()
+}
+
+func (fc *fakeCommand) Start() error {
+	fc.done = make(chan error, 1)
+	fc.interrupted = make(chan struct{})
+	// Standard input is read concurrently, like the buffered pipes of real
+	// targets would allow.
+	stdinRead := make(chan struct{})
+	go func() {
+		defer close(stdinRead)
+		if fc.stdin == nil {
+			return
+		}
+		in, _ := ioutil.ReadAll(fc.stdin)
+		fc.target.mutex.Lock()
+		defer fc.target.mutex.Unlock()
+		if fc.target.inputs == nil {
+			fc.target.inputs = map[string]string{}
+		}
+		fc.target.inputs[fc.cmd] += string(in)
+	}()
+	go func() {
+		var delay time.Duration
+		if strings.HasSuffix(fc.cmd, ".sh") { // only script executions are delayed and counted
+			delay = fc.target.delay
+			if fc.target.slow != "" && strings.Contains(fc.cmd, fc.target.slow) {
+				delay = time.Minute
+			}
+			fc.target.enter()
+			defer fc.target.leave()
+		}
+		defer func() {
+			for _, c := range fc.closers {
+				c.Close()
+			}
+		}()
+		switch {
+		case strings.Contains(fc.cmd, "echo locked") && fc.target.noFlock:
+			fc.done <- exec.Command("sh", "-c", "exit 127").Run()
+			return
+		case strings.Contains(fc.cmd, "echo locked"):
+			if fc.target.lockHolder() != "" {
+				fc.done <- fmt.Errorf("exit status 1")
+				return
+			}
+			io.WriteString(fc.stdout, "locked\n")
+			if fc.target.loseLock() {
+				fc.done <- fmt.Errorf("connection lost")
+				return
+			}
+		case strings.Contains(fc.cmd, "cat ") && strings.Contains(fc.cmd, ".lock.info"):
+			if holder := fc.target.lockHolder(); holder != "" {
+				io.WriteString(fc.stdout, holder+"\nheld\n")
+			}
+		case mktempDir.MatchString(fc.cmd):
+			io.WriteString(fc.stdout, mktempDir.FindStringSubmatch(fc.cmd)[1]+"/urknall.fake\n")
+		case strings.Contains(fc.cmd, "pkill"):
+			fc.target.mutex.Lock()
+			fc.target.lockedBy = ""
+			fc.target.mutex.Unlock()
+		}
+		<-stdinRead
+		for k, out := range fc.target.outputs {
+			if fc.stdout != nil && strings.Contains(fc.cmd, k) {
+				io.WriteString(fc.stdout, out)
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-fc.interrupted:
+			fc.done <- fmt.Errorf("killed")
+			return
+		}
+		if fc.target.failing != "" && strings.Contains(fc.cmd, fc.target.failing) && fc.target.fail() {
+			if fc.target.failErr != nil {
+				fc.done <- fc.target.failErr
+				return
+			}
+			fc.done <- fmt.Errorf("command failed")
+			return
+		}
+		fc.done <- nil
+	}()
+	return nil
+}
+
+func (fc *fakeCommand) Interrupt() error {
+	close(fc.interrupted)
+	return nil
+}
+
+func (fc *fakeCommand) Wait() error {
+	return <-fc.done
+}
+
+func fleetTemplate(pkg Package) {
+	pkg.AddCommands("base", Shell("echo base"))
+}
+
+func TestMultiBuildRun(t *testing.T) {
+	targets := []Target{}
+	fakes := []*fakeTarget{}
+	for i := 0; i < 4; i++ {
+		ft := &fakeTarget{name: fmt.Sprintf("host%d", i)}
+		fakes = append(fakes, ft)
+		targets = append(targets, ft)
+	}
+
+	mb := &MultiBuild{Targets: targets, Build: Build{Template: TemplateFunc(fleetTemplate)}, Concurrency: 2}
+	if e := mb.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+
+	for _, ft := range fakes {
+		found := false
+		for _, c := range ft.commands {
+			if strings.Contains(c, "echo base") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected command to be executed on %s, wasn't", ft.name)
+		}
+	}
+}
+
+func TestMultiBuildConcurrencyLimit(t *testing.T) {
+	for _, limit := range []int{2, 3} {
+		gauge := &runGauge{}
+		targets := []Target{}
+		for i := 0; i < 6; i++ {
+			targets = append(targets, &fakeTarget{name: fmt.Sprintf("host%d", i), delay: 50 * time.Millisecond, gauge: gauge})
+		}
+
+		mb := &MultiBuild{Targets: targets, Build: Build{Template: TemplateFunc(fleetTemplate)}, Concurrency: limit}
+		if e := mb.Run(); e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+		if gauge.peak != limit {
+			t.Errorf("expected %d targets to be provisioned at the same time, got %d", limit, gauge.peak)
+		}
+	}
+}
+
+func TestMultiBuildErrors(t *testing.T) {
+	good := &fakeTarget{name: "good"}
+	bad := &fakeTarget{name: "bad", failing: "echo base"}
+
+	mb := &MultiBuild{Targets: []Target{good, bad}, Build: Build{Template: TemplateFunc(fleetTemplate)}}
+	e := mb.Run()
+	if e == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	me, ok := e.(MultiBuildError)
+	if !ok {
+		t.Fatalf("expected error of type %T, got %T", me, e)
+	}
+	if len(me) != 1 {
+		t.Fatalf("expected %d failed target, got %d", 1, len(me))
+	}
+	if me[0].Hostname != "bad" {
+		t.Errorf("expected failed target to be %q, got %q", "bad", me[0].Hostname)
+	}
+}
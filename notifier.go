@@ -0,0 +1,64 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The type of a build's lifecycle event.
+type EventType string
+
+const (
+	EventBuildStarted  EventType = "build.started"  // All tasks are prepared, before the first one is run.
+	EventBuildFinished EventType = "build.finished" // All tasks finished successfully.
+	EventBuildFailed   EventType = "build.failed"   // Preparing the build or a task failed, or the build was interrupted.
+	EventTaskStarting  EventType = "task.starting"  // The task's first command not cached is about to be executed.
+	EventTaskCompleted EventType = "task.completed" // All of the task's commands succeeded, at least one was executed.
+)
+
+// A lifecycle event of a build.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Host     string // The build's target.
+	Template string // Name of the template (or task) added first, identifying the build.
+	Task     string // Name of the task (task events only).
+	Error    error  // Reason of the failure (EventBuildFailed only).
+}
+
+// A notifier receives the lifecycle events of builds (see Build.Notifier).
+// Notify is called synchronously, i.e. it delays the build. With
+// MaxParallelTasks greater than 1 it is called concurrently. Errors are logged,
+// but don't fail the build.
+type Notifier interface {
+	Notify(ev *Event) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface.
+type NotifierFunc func(ev *Event) error
+
+func (f NotifierFunc) Notify(ev *Event) error {
+	return f(ev)
+}
+
+// notify sends an event of the given type to the build's notifier, if any.
+func (build *Build) notify(typ EventType, task string, err error) {
+	if build.Notifier == nil {
+		return
+	}
+	ev := &Event{Type: typ, Time: time.Now(), Host: build.hostname(), Template: build.name, Task: task, Error: err}
+	if e := build.Notifier.Notify(ev); e != nil {
+		logError(fmt.Errorf("failed to notify %s event: %s", typ, e))
+	}
+}
+
+// name returns the name of the package's first top level template or task.
+func (pkg *packageImpl) name() string {
+	for _, t := range pkg.tasks {
+		if t.name != "" {
+			return strings.Split(t.name, ".")[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package urknall
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []*Event
+}
+
+func (r *eventRecorder) Notify(ev *Event) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func (r *eventRecorder) summary() []string {
+	s := []string{}
+	for _, ev := range r.events {
+		s = append(s, string(ev.Type)+" "+ev.Template+" "+ev.Task)
+	}
+	return s
+}
+
+func TestBuildNotifier(t *testing.T) {
+	first, _ := commandChecksum(Shell("echo first"))
+	ft := &fakeTarget{
+		name:    "host",
+		outputs: map[string]string{"*.run": ukCACHEDIR + "/base/" + first + ".done\n"},
+	}
+	rec := &eventRecorder{}
+	tpl := TemplateFunc(func(pkg Package) {
+		planTemplate(pkg)
+		pkg.AddCommands("cached", Shell("echo first"))
+	})
+	ft.outputs["*.run"] += ukCACHEDIR + "/cached/" + first + ".done\n"
+	b := &Build{Target: ft, Template: tpl, Notifier: rec}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	expected := []string{
+		"build.started base ",
+		"task.starting base base",
+		"task.completed base base",
+		"build.finished base ",
+	}
+	if s := rec.summary(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected events %v, got %v", expected, s)
+	}
+	if rec.events[0].Host != "host" {
+		t.Errorf("expected host %q, got %q", "host", rec.events[0].Host)
+	}
+
+	ft = &fakeTarget{name: "host", failing: "sh " + ukCACHEDIR + "/base/"}
+	rec = &eventRecorder{}
+	b = &Build{Target: ft, Template: TemplateFunc(planTemplate), Notifier: rec}
+	if e := b.Run(); e == nil {
+		t.Fatalf("expected an error")
+	}
+	expected = []string{"build.started base ", "task.starting base base", "build.failed base "}
+	if s := rec.summary(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected events %v, got %v", expected, s)
+	}
+	if rec.events[2].Error == nil {
+		t.Errorf("expected failure event to carry the error")
+	}
+}
+
+func TestBuildNotifierPrepareFailure(t *testing.T) {
+	// The build fails while preparing the target, i.e. before it started.
+	ft := &fakeTarget{name: "host", failing: "/etc/group"}
+	rec := &eventRecorder{}
+	b := &Build{Target: ft, Template: TemplateFunc(planTemplate), Notifier: rec, DisableLock: true}
+	if e := b.Run(); e == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := []string{"build.failed base "}
+	if s := rec.summary(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected events %v, got %v", expected, s)
+	}
+
+	// Rendering fails.
+	rec = &eventRecorder{}
+	b = &Build{Target: &fakeTarget{name: "host"}, Template: TemplateFunc(func(pkg Package) {
+		pkg.AddTask("a", NotifyHandlers(NewTask().Add(Shell("echo a")), "missing"))
+	}), Notifier: rec}
+	if e := b.Run(); e == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(rec.events) != 1 || rec.events[0].Type != EventBuildFailed || rec.events[0].Error == nil {
+		t.Errorf("expected a failure event, got %v", rec.summary())
+	}
+}
@@ -10,9 +10,12 @@ import (
 
 type packageImpl struct {
 	tasks          []*task
+	handlers       []*task
 	taskNames      map[string]struct{}
 	reference      interface{} // used for rendering
 	cacheKeyPrefix string
+	facts          *targetFacts
+	secrets        *secretRegistry // secrets of the build (see AddSecret), shared with child packages
 }
 
 func (pkg *packageImpl) AddCommands(name string, cmds ...cmd.Command) {
@@ -20,21 +23,45 @@ func (pkg *packageImpl) AddCommands(name string, cmds ...cmd.Command) {
 		name = pkg.cacheKeyPrefix + "." + name
 	}
 	name = utils.MustRenderTemplate(name, pkg.reference)
-	t := &task{name: name}
+	t := &task{name: name, scope: pkg.cacheKeyPrefix}
 	for _, c := range cmds {
 		if r, ok := c.(cmd.Renderer); ok {
 			r.Render(pkg.reference)
 		}
 		t.Add(c)
 	}
+	pkg.renderEnv(t)
 	pkg.addTask(t)
 }
 
+func (pkg *packageImpl) addHandler(name string, cmds ...cmd.Command) {
+	if pkg.cacheKeyPrefix != "" {
+		name = pkg.cacheKeyPrefix + "." + name
+	}
+	name = utils.MustRenderTemplate(name, pkg.reference)
+	pkg.validateTaskName(name)
+	h := &task{name: name, scope: pkg.cacheKeyPrefix, handler: true}
+	for _, c := range cmds {
+		if r, ok := c.(cmd.Renderer); ok {
+			r.Render(pkg.reference)
+		}
+		h.Add(c)
+	}
+	pkg.renderEnv(h)
+	pkg.taskNames[name] = struct{}{}
+	pkg.handlers = append(pkg.handlers, h)
+}
+
+func (pkg *packageImpl) flushHandlers() {
+	pkg.tasks = append(pkg.tasks, &task{flush: true, scope: pkg.cacheKeyPrefix})
+}
+
 func (pkg *packageImpl) AddTemplate(name string, tpl Template) {
 	if pkg.cacheKeyPrefix != "" {
 		name = pkg.cacheKeyPrefix + "." + name
 	}
 	name = utils.MustRenderTemplate(name, pkg.reference)
+	tpl = withFacts(tpl, pkg.facts)
 	e := validateTemplate(tpl)
 	if e != nil {
 		panic(e)
@@ -43,11 +70,26 @@ func (pkg *packageImpl) AddTemplate(name string, tpl Template) {
 		name = utils.MustRenderTemplate(name, pkg.reference)
 	}
 	pkg.validateTaskName(name)
-	child := &packageImpl{cacheKeyPrefix: name, reference: tpl}
+	if pkg.secrets == nil {
+		pkg.secrets = newSecretRegistry(secrets)
+	}
+	child := &packageImpl{cacheKeyPrefix: name, reference: tpl, facts: pkg.facts, secrets: pkg.secrets}
 	tpl.Render(child)
+	if d, ok := tpl.(Dependent); ok {
+		pkg.addDependencies(child.tasks, d.Dependencies())
+	}
 	for _, task := range child.tasks {
+		if task.flush {
+			pkg.tasks = append(pkg.tasks, task)
+			continue
+		}
 		pkg.addTask(task)
 	}
+	for _, h := range child.handlers {
+		pkg.validateTaskName(h.name)
+		pkg.taskNames[h.name] = struct{}{}
+		pkg.handlers = append(pkg.handlers, h)
+	}
 }
 
 func (pkg *packageImpl) AddTask(name string, tsk Task) {
@@ -55,7 +97,7 @@ func (pkg *packageImpl) AddTask(name string, tsk Task) {
 		name = pkg.cacheKeyPrefix + "." + name
 	}
 	name = utils.MustRenderTemplate(name, pkg.reference)
-	t := &task{name: name}
+	t := &task{name: name, scope: pkg.cacheKeyPrefix}
 	cmds, e := tsk.Commands()
 	if e != nil {
 		panic(e)
@@ -63,6 +105,14 @@ func (pkg *packageImpl) AddTask(name string, tsk Task) {
 	for _, c := range cmds {
 		t.Add(c)
 	}
+	if dt, ok := tsk.(*task); ok {
+		for _, d := range dt.dependencies {
+			t.dependencies = append(t.dependencies, dependency{name: d.name, scope: pkg.cacheKeyPrefix})
+		}
+		t.notifies = append(t.notifies, dt.notifies...)
+		t.env = append(t.env, dt.env...)
+	}
+	pkg.renderEnv(t)
 	pkg.addTask(t)
 }
 
@@ -0,0 +1,104 @@
+package urknall
+
+import "github.com/megamsys/urknall/utils"
+
+// A plan describes what a build would do on its target, without actually doing
+// it. It can be serialized to JSON for review.
+type Plan struct {
+	Hostname string      `json:"hostname"`
+	Tasks    []*TaskPlan `json:"tasks"`
+}
+
+// The plan of a single task.
+type TaskPlan struct {
+	Name     string         `json:"name"`
+	Commands []*CommandPlan `json:"commands"`
+
+	// Index of the first command that is not cached, i.e. the command that
+	// breaks the cache. Set to -1 if all commands are cached.
+	CacheBreak int `json:"cache_break"`
+
+	// Handlers are only executed if triggered by a command executed before.
+	Handler   bool `json:"handler,omitempty"`
+	Triggered bool `json:"triggered,omitempty"`
+
+	// Only set with the build's Explain flag: checksum of the command
+	// previously executed at the CacheBreak index (empty if there was none)
+	// and a unified diff of its script and the new one.
+	PreviousChecksum string `json:"previous_checksum,omitempty"`
+	Diff             string `json:"diff,omitempty"`
+}
+
+// The plan of a single command.
+type CommandPlan struct {
+	Checksum string `json:"checksum"` // Checksum used for caching.
+	Message  string `json:"message"`  // The command's log message.
+	Script   string `json:"script"`   // The rendered shell script executed on the target.
+	Cached   bool   `json:"cached"`   // Whether the command is cached (or will be executed).
+
+	// Whether the command is cached, but will be executed due to the build's
+	// invalidation options.
+	Invalidated bool `json:"invalidated,omitempty"`
+}
+
+// Plan renders the build's template and compares the result with the cache on
+// the target. The returned plan lists all tasks and commands and whether they
+// would be executed by Run.
+func (b *Build) Plan() (*Plan, error) {
+	pkg, e := b.prepareBuild()
+	if e != nil {
+		return nil, e
+	}
+	defer b.releaseLock()
+
+	plan := &Plan{Hostname: b.hostname()}
+	handlers, e := b.loadHandlers(pkg.tasks, false)
+	if e != nil {
+		return nil, e
+	}
+	for _, task := range pkg.tasks {
+		tp := &TaskPlan{Name: task.name, CacheBreak: -1, Handler: task.handler}
+		if task.handler {
+			tp.Triggered = handlers.isTriggered(task.name)
+		}
+		for i, command := range task.commands {
+			if !command.cached && tp.CacheBreak == -1 {
+				tp.CacheBreak = i
+			}
+			if !command.cached {
+				_ = handlers.trigger(command.triggers) // not persisted
+			}
+			tp.Commands = append(tp.Commands, &CommandPlan{
+				Checksum:    command.Checksum(),
+				Message:     command.LogMsg(),
+				Script:      b.renderScript(command.command, command.env),
+				Cached:      command.cached,
+				Invalidated: command.invalidated,
+			})
+		}
+		if b.Explain && tp.CacheBreak != -1 && !task.handler {
+			if e = b.explain(task, tp); e != nil {
+				return nil, e
+			}
+		}
+		plan.Tasks = append(plan.Tasks, tp)
+	}
+	return plan, nil
+}
+
+// explain fetches the script previously executed at the task's cache break
+// from the target and adds a diff to the new script to the plan.
+func (b *Build) explain(task *task, tp *TaskPlan) error {
+	current := tp.Commands[tp.CacheBreak]
+	previous, previousName := "", "/dev/null"
+	if tp.CacheBreak < len(task.cachedChecksums) {
+		tp.PreviousChecksum = task.cachedChecksums[tp.CacheBreak]
+		script, e := b.state().Script(b, task.name, tp.PreviousChecksum)
+		if e != nil {
+			return e
+		}
+		previous, previousName = script, tp.PreviousChecksum+".done"
+	}
+	tp.Diff = utils.Diff(previous, current.Script, previousName, current.Checksum+".sh")
+	return nil
+}
@@ -0,0 +1,78 @@
+package urknall
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func planTemplate(pkg Package) {
+	pkg.AddCommands("base", Shell("echo first"), Shell("echo second"))
+}
+
+func TestBuildPlan(t *testing.T) {
+	first, _ := checksumWith(Shell("echo first"), []string{"FOO=bar"}, nil)
+	ft := &fakeTarget{
+		name:    "host",
+		outputs: map[string]string{"*.run": ukCACHEDIR + "/base/" + first + ".done\n"},
+	}
+	b := &Build{Target: ft, Template: TemplateFunc(planTemplate), Env: []string{"FOO=bar"}}
+
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if plan.Hostname != "host" {
+		t.Errorf("expected hostname %q, got %q", "host", plan.Hostname)
+	}
+	if len(plan.Tasks) != 1 {
+		t.Fatalf("expected %d task, got %d", 1, len(plan.Tasks))
+	}
+
+	tp := plan.Tasks[0]
+	if tp.CacheBreak != 1 {
+		t.Errorf("expected cache to break at command %d, got %d", 1, tp.CacheBreak)
+	}
+	if len(tp.Commands) != 2 {
+		t.Fatalf("expected %d commands, got %d", 2, len(tp.Commands))
+	}
+	if !tp.Commands[0].Cached || tp.Commands[1].Cached {
+		t.Errorf("expected only first command to be cached")
+	}
+	if tp.Commands[0].Checksum != first {
+		t.Errorf("expected checksum %q, got %q", first, tp.Commands[0].Checksum)
+	}
+	if !strings.Contains(tp.Commands[1].Script, "export FOO=bar\n") || !strings.HasSuffix(tp.Commands[1].Script, "echo second") {
+		t.Errorf("unexpected script %q", tp.Commands[1].Script)
+	}
+
+	if _, e := json.Marshal(plan); e != nil {
+		t.Errorf("didn't expect an error, got %q", e)
+	}
+}
+
+func TestBuildPlanExplain(t *testing.T) {
+	first, _ := commandChecksum(Shell("echo first"))
+	second, _ := commandChecksum(Shell("echo 2nd"))
+	b := &Build{Template: TemplateFunc(planTemplate), Explain: true}
+	previous := b.renderScript(Shell("echo 2nd"), nil) + "\n"
+	b.Target = &fakeTarget{
+		name: "host",
+		outputs: map[string]string{
+			"*.run":          ukCACHEDIR + "/base/" + first + ".done\n" + ukCACHEDIR + "/base/" + second + ".done\n",
+			second + ".done": previous,
+		},
+	}
+
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	tp := plan.Tasks[0]
+	if tp.PreviousChecksum != second {
+		t.Errorf("expected previous checksum %q, got %q", second, tp.PreviousChecksum)
+	}
+	if !strings.Contains(tp.Diff, "\n-echo 2nd\n+echo second\n") {
+		t.Errorf("expected diff to contain changed command, got %q", tp.Diff)
+	}
+}
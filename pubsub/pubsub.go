@@ -31,6 +31,8 @@ const (
 	StatusCached       = "CACHED"
 	StatusExecStart    = "EXEC"
 	StatusExecFinished = "FINISHED"
+	StatusExecRetry    = "RETRY"
+	StatusInvalidated  = "INVALID"
 )
 
 const (
@@ -66,6 +68,8 @@ type Message struct {
 
 	InvalidatedCacheEntries []string // List of invalidated cache entries (urknall caching).
 
+	Attempt int // Number of the failed attempt (retries only).
+
 	Error error  // Error that occured.
 	Stack string // The stack trace in case of a panic.
 }
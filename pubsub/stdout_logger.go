@@ -14,11 +14,16 @@ const (
 	colorDryRun = 226
 	colorCached = 33
 	colorExec   = 46
+	colorRetry  = 208
+
+	colorDiffRemoved = 196
 )
 
 var colorMapping = map[string]int{
 	StatusCached:       colorCached,
 	StatusExecFinished: colorExec,
+	StatusExecRetry:    colorRetry,
+	StatusInvalidated:  colorDryRun,
 }
 
 var ignoredMessagesError = errors.New("ignored published messages (subscriber buffer full)")
@@ -54,8 +59,13 @@ func (logger *logger) Started() time.Time {
 func (logger *logger) formatCommandOuput(message *Message) string {
 	prefix := fmt.Sprintf("[%s][%s][%s]", formatIp(message.Hostname), formatTaskName(message.TaskName, 12), formatDuration(logger.sinceStarted()))
 	line := message.Line
-	if message.IsStderr() {
+	switch {
+	case message.IsStderr():
 		line = colorize(34, line)
+	case message.Stream == "diff" && strings.HasPrefix(line, "+"):
+		line = colorize(colorExec, line)
+	case message.Stream == "diff" && strings.HasPrefix(line, "-"):
+		line = colorize(colorDiffRemoved, line)
 	}
 	return prefix + " " + line
 }
@@ -0,0 +1,95 @@
+package urknall
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Number of lines of a command's stderr kept in its result.
+const stderrTailLines = 10
+
+// The status of a command after a build.
+type CommandStatus string
+
+const (
+	CommandCached   CommandStatus = "cached"   // The command was cached and not executed.
+	CommandExecuted CommandStatus = "executed" // The command was executed successfully.
+	CommandFailed   CommandStatus = "failed"   // The command was executed and failed.
+	CommandSkipped  CommandStatus = "skipped"  // The command wasn't executed, as the build failed before (or the handler wasn't triggered).
+)
+
+// A build result describes what a build did on its target. It can be
+// serialized to JSON for reports.
+type BuildResult struct {
+	Hostname string        `json:"hostname"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Tasks    []*TaskResult `json:"tasks"`
+	Error    string        `json:"error,omitempty"` // The error the build failed with.
+}
+
+// The result of a single task.
+type TaskResult struct {
+	Name     string           `json:"name"`
+	Started  time.Time        `json:"started"`  // Zero if the task wasn't started.
+	Finished time.Time        `json:"finished"` // Zero if the task wasn't started.
+	Commands []*CommandResult `json:"commands"`
+}
+
+// The result of a single command. Timings, exit code and output are only set
+// for commands that were executed.
+type CommandResult struct {
+	Checksum    string        `json:"checksum"`
+	Message     string        `json:"message"`
+	Status      CommandStatus `json:"status"`
+	Started     time.Time     `json:"started"`
+	Finished    time.Time     `json:"finished"`
+	ExitCode    int           `json:"exit_code"`             // -1 if the command didn't exit normally.
+	Attempts    int           `json:"attempts"`              // Number of executions (see cmd.RetryPolicy).
+	StdoutBytes int64         `json:"stdout_bytes"`          // Number of bytes written to stdout.
+	StderrBytes int64         `json:"stderr_bytes"`          // Number of bytes written to stderr.
+	StderrTail  []string      `json:"stderr_tail,omitempty"` // The last lines written to stderr.
+	Error       string        `json:"error,omitempty"`
+}
+
+// Like RunContext, but a result describing all tasks and commands of the build
+// is returned. The result is returned even if the build failed.
+func (b *Build) RunWithResult(ctx context.Context) (*BuildResult, error) {
+	res := &BuildResult{Hostname: b.hostname(), Started: time.Now()}
+	e := b.run(ctx, res)
+	res.Finished = time.Now()
+	if e != nil {
+		res.Error = e.Error()
+	}
+	return res, e
+}
+
+func newTaskResult(tsk *task) *TaskResult {
+	tr := &TaskResult{Name: tsk.name}
+	for _, c := range tsk.commands {
+		tr.Commands = append(tr.Commands, &CommandResult{
+			Checksum: c.Checksum(),
+			Message:  c.LogMsg(),
+			Status:   CommandSkipped,
+		})
+	}
+	return tr
+}
+
+// record the outcome of the given runner in the command's result.
+func (cr *CommandResult) record(runner *commandRunner, err error) {
+	cr.Started, cr.Finished = runner.commandStarted, time.Now()
+	cr.StdoutBytes, cr.StderrBytes = runner.stdoutBytes, runner.stderrBytes
+	cr.StderrTail = runner.stderrTail
+	cr.Status, cr.ExitCode = CommandExecuted, 0
+	if ce, ok := err.(*CommandError); ok {
+		cr.ExitCode = ce.ExitCode
+	}
+	if err != nil {
+		cr.Status, cr.Error = CommandFailed, err.Error()
+		if _, ok := err.(*InterruptError); ok {
+			cr.ExitCode = -1
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package urknall
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func resultTemplate(pkg Package) {
+	pkg.AddCommands("base", Shell("echo first"), Shell("echo second"), Shell("echo third"))
+	pkg.AddCommands("other", Shell("echo other"))
+}
+
+func TestBuildRunWithResult(t *testing.T) {
+	first, _ := commandChecksum(Shell("echo first"))
+	second, _ := commandChecksum(Shell("echo second"))
+	ft := &fakeTarget{
+		name:    "host",
+		failing: "sh " + ukCACHEDIR + "/base/" + second + ".sh",
+		outputs: map[string]string{
+			"*.run":        ukCACHEDIR + "/base/" + first + ".done\n",
+			second + ".sh": "hello\nworld\n",
+		},
+	}
+	b := &Build{Target: ft, Template: TemplateFunc(resultTemplate)}
+
+	res, e := b.RunWithResult(context.Background())
+	if e == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	if res.Hostname != "host" || res.Error != e.Error() {
+		t.Errorf("unexpected result %#v", res)
+	}
+	if res.Started.IsZero() || res.Finished.Before(res.Started) {
+		t.Errorf("expected build timings to be set, got %s and %s", res.Started, res.Finished)
+	}
+	if len(res.Tasks) != 2 {
+		t.Fatalf("expected %d tasks, got %d", 2, len(res.Tasks))
+	}
+
+	statuses := []CommandStatus{}
+	for _, tr := range res.Tasks {
+		for _, cr := range tr.Commands {
+			statuses = append(statuses, cr.Status)
+		}
+	}
+	expected := []CommandStatus{CommandCached, CommandFailed, CommandSkipped, CommandSkipped}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected statuses %v, got %v", expected, statuses)
+	}
+
+	cr := res.Tasks[0].Commands[1]
+	if cr.Checksum != second {
+		t.Errorf("expected checksum %q, got %q", second, cr.Checksum)
+	}
+	if cr.StdoutBytes != 12 {
+		t.Errorf("expected %d bytes written to stdout, got %d", 12, cr.StdoutBytes)
+	}
+	if cr.ExitCode != -1 || cr.Error == "" {
+		t.Errorf("expected failure to be recorded, got exit code %d and error %q", cr.ExitCode, cr.Error)
+	}
+	if cr.Started.IsZero() || cr.Finished.Before(cr.Started) {
+		t.Errorf("expected command timings to be set, got %s and %s", cr.Started, cr.Finished)
+	}
+	if !res.Tasks[1].Started.IsZero() {
+		t.Errorf("expected second task not to be started")
+	}
+}
+
+func TestCommandRunnerStderrTail(t *testing.T) {
+	runner := &commandRunner{}
+	for i := 0; i < stderrTailLines+5; i++ {
+		runner.countLine("stderr", fmt.Sprintf("line %d", i))
+	}
+	runner.countLine("stdout", "out")
+
+	if len(runner.stderrTail) != stderrTailLines {
+		t.Fatalf("expected %d lines, got %d", stderrTailLines, len(runner.stderrTail))
+	}
+	if runner.stderrTail[0] != "line 5" {
+		t.Errorf("expected tail to start with %q, got %q", "line 5", runner.stderrTail[0])
+	}
+	if runner.stderrBytes != 10*7+5*8 || runner.stdoutBytes != 4 {
+		t.Errorf("unexpected byte counts %d and %d", runner.stderrBytes, runner.stdoutBytes)
+	}
+}
@@ -0,0 +1,198 @@
+package urknall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/megamsys/urknall/cmd"
+	"github.com/megamsys/urknall/pubsub"
+	"github.com/megamsys/urknall/target"
+	"golang.org/x/net/context"
+)
+
+// The policy used to retry internal commands on transient errors of the
+// connection to the target.
+var internalRetryPolicy = &cmd.RetryPolicy{Attempts: 3, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+func (build *Build) retryPolicy(c cmd.Command) *cmd.RetryPolicy {
+	if r, ok := c.(cmd.Retrier); ok && r.RetryPolicy() != nil {
+		return r.RetryPolicy()
+	}
+	return build.Retry
+}
+
+// runCommand executes the given command of the task, retrying it according to
+// its retry policy. Failed attempts are recorded in the task's run log.
+func (build *Build) runCommand(ctx context.Context, tsk *task, c *commandWrapper, cr *CommandResult) error {
+	policy := build.retryPolicy(c.command)
+	for attempt := 1; ; attempt++ {
+		r := &commandRunner{
+			build:    build,
+			command:  c.command,
+			checksum: c.Checksum(),
+			input:    c.input,
+			env:      c.env,
+			taskName: tsk.name,
+		}
+		e := r.run(ctx)
+		cr.record(r, e)
+		cr.Attempts = attempt
+		if e == nil || ctx.Err() != nil || !retryable(policy, attempt, e) {
+			return e
+		}
+
+		if err := build.addCmdToTaskLog(tsk, c.Checksum(), e); err != nil {
+			return err
+		}
+		m := message(pubsub.MessageTasksProvisionTask, build.hostname(), tsk.name)
+		m.TaskChecksum = c.Checksum()
+		m.Message = c.LogMsg()
+		m.ExecStatus = pubsub.StatusExecRetry
+		m.Attempt = attempt
+		m.Error = e
+		m.Publish("retry")
+
+		select {
+		case <-time.After(retryDelay(policy, attempt)):
+		case <-ctx.Done():
+			return &InterruptError{TaskName: tsk.name, Checksum: c.Checksum(), Err: ctx.Err()}
+		}
+	}
+}
+
+// retryable returns whether a command failing with the given error in the
+// given attempt should be retried.
+func retryable(policy *cmd.RetryPolicy, attempt int, e error) bool {
+	if policy == nil || attempt >= policy.Attempts {
+		return false
+	}
+	switch err := e.(type) {
+	case *CommandError:
+		if err.Err == nil {
+			return false // only writing the log failed, the command itself succeeded
+		}
+		if len(policy.ExitCodes) == 0 {
+			return true
+		}
+		for _, code := range policy.ExitCodes {
+			if err.ExitCode == code {
+				return true
+			}
+		}
+		return false
+	default:
+		return len(policy.ExitCodes) == 0
+	}
+}
+
+// retryDelay returns the delay before the retry following the given attempt.
+func retryDelay(policy *cmd.RetryPolicy, attempt int) time.Duration {
+	delay := policy.Backoff
+	for i := 1; i < attempt && (policy.MaxBackoff == 0 || delay < policy.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+		delay = policy.MaxBackoff
+	}
+	return delay
+}
+
+// internalCommand wraps the commands urknall uses for bookkeeping on the
+// target. Run retries those on transient errors of the connection (see
+// target.IsTransient). Commands using pipes or standard input are not retried.
+type internalCommand struct {
+	target.ExecCommand
+
+	build  *Build
+	rawCmd string
+
+	stdout, stderr io.Writer
+	stdin          io.Reader
+	piped          bool
+}
+
+// renew creates the underlying command. If that fails due to a broken
+// connection, the target is reset once.
+func (c *internalCommand) renew() error {
+	ec, e := c.build.prepareCommand(c.rawCmd)
+	if e != nil && target.IsTransient(e) {
+		_ = c.build.Reset()
+		ec, e = c.build.prepareCommand(c.rawCmd)
+	}
+	if e != nil {
+		return e
+	}
+	c.ExecCommand = ec
+	return nil
+}
+
+func (c *internalCommand) StdoutPipe() (io.Reader, error) {
+	c.piped = true
+	return c.ExecCommand.StdoutPipe()
+}
+
+func (c *internalCommand) StderrPipe() (io.Reader, error) {
+	c.piped = true
+	return c.ExecCommand.StderrPipe()
+}
+
+func (c *internalCommand) StdinPipe() (io.WriteCloser, error) {
+	c.piped = true
+	return c.ExecCommand.StdinPipe()
+}
+
+func (c *internalCommand) SetStdout(w io.Writer) { c.stdout = w }
+func (c *internalCommand) SetStderr(w io.Writer) { c.stderr = w }
+func (c *internalCommand) SetStdin(r io.Reader)  { c.stdin = r }
+
+func (c *internalCommand) Start() error {
+	c.apply(c.stdout, c.stderr)
+	return c.ExecCommand.Start()
+}
+
+func (c *internalCommand) Run() error {
+	if c.piped || c.stdin != nil {
+		c.apply(c.stdout, c.stderr)
+		return c.ExecCommand.Run()
+	}
+
+	for attempt := 1; ; attempt++ {
+		// Output is buffered, so that a failed attempt's output isn't mixed in.
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		c.apply(out, err)
+		e := c.ExecCommand.Run()
+		if e == nil || !target.IsTransient(e) || attempt >= internalRetryPolicy.Attempts {
+			c.copyOutput(out, err)
+			return e
+		}
+
+		logError(fmt.Errorf("internal command failed on attempt %d, retrying: %s", attempt, e))
+		time.Sleep(retryDelay(internalRetryPolicy, attempt))
+		if e = c.renew(); e != nil {
+			return e
+		}
+	}
+}
+
+func (c *internalCommand) apply(stdout, stderr io.Writer) {
+	if c.stdout != nil {
+		c.ExecCommand.SetStdout(stdout)
+	}
+	if c.stderr != nil {
+		c.ExecCommand.SetStderr(stderr)
+	}
+	if c.stdin != nil {
+		c.ExecCommand.SetStdin(c.stdin)
+	}
+}
+
+func (c *internalCommand) copyOutput(out, err *bytes.Buffer) {
+	if c.stdout != nil && out.Len() > 0 {
+		io.Copy(c.stdout, out)
+	}
+	if c.stderr != nil && err.Len() > 0 {
+		io.Copy(c.stderr, err)
+	}
+}
@@ -0,0 +1,147 @@
+package urknall
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megamsys/urknall/cmd"
+	"golang.org/x/net/context"
+)
+
+type retryCommand struct {
+	cmd.Command
+	policy *cmd.RetryPolicy
+}
+
+func (c *retryCommand) RetryPolicy() *cmd.RetryPolicy {
+	return c.policy
+}
+
+func TestBuildRetry(t *testing.T) {
+	checksum, _ := commandChecksum(Shell("echo base"))
+	script := "sh " + ukCACHEDIR + "/base/" + checksum + ".sh"
+
+	data := []struct {
+		policy   *cmd.RetryPolicy
+		failures int
+		attempts int
+		success  bool
+	}{
+		{nil, 1, 1, false},
+		{&cmd.RetryPolicy{Attempts: 3}, 2, 3, true},
+		{&cmd.RetryPolicy{Attempts: 2}, 2, 2, false},
+		{&cmd.RetryPolicy{Attempts: 3, ExitCodes: []int{100}}, 1, 1, false},
+	}
+
+	for i, d := range data {
+		ft := &fakeTarget{name: "host", failing: script, failures: d.failures}
+		b := &Build{Target: ft, Template: TemplateFunc(fleetTemplate), Retry: d.policy}
+		res, e := b.RunWithResult(context.Background())
+		if d.success != (e == nil) {
+			t.Errorf("%d: expected success to be %t, got error %v", i, d.success, e)
+		}
+		if attempts := res.Tasks[0].Commands[0].Attempts; attempts != d.attempts {
+			t.Errorf("%d: expected %d attempts, got %d", i, d.attempts, attempts)
+		}
+		// Each failed attempt is recorded in the run log.
+		failed := d.attempts
+		if d.success {
+			failed--
+		}
+		if cnt := countCommands(ft, checksum+".failed"); cnt != failed {
+			t.Errorf("%d: expected %d failed attempts to be recorded, got %d", i, failed, cnt)
+		}
+	}
+}
+
+func TestBuildRetrier(t *testing.T) {
+	c := &retryCommand{Command: Shell("echo base"), policy: &cmd.RetryPolicy{Attempts: 2}}
+	checksum, _ := commandChecksum(c)
+	ft := &fakeTarget{name: "host", failing: "sh " + ukCACHEDIR + "/base/" + checksum + ".sh", failures: 1}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("base", c)
+	})
+
+	if e := (&Build{Target: ft, Template: tpl}).Run(); e != nil {
+		t.Errorf("didn't expect an error, got %q", e)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := &cmd.RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, expected := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if expected == 0 {
+			continue
+		}
+		if delay := retryDelay(policy, attempt); delay != expected {
+			t.Errorf("attempt %d: expected delay %s, got %s", attempt, expected, delay)
+		}
+	}
+}
+
+func TestInternalCommandRetry(t *testing.T) {
+	defer func(policy *cmd.RetryPolicy) { internalRetryPolicy = policy }(internalRetryPolicy)
+	internalRetryPolicy = &cmd.RetryPolicy{Attempts: 3}
+
+	ft := &fakeTarget{name: "host", failing: `cat "$run"`, failures: 2, failErr: io.EOF}
+	if e := (&Build{Target: ft, Template: TemplateFunc(fleetTemplate)}).Run(); e != nil {
+		t.Errorf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, `cat "$run"`); cnt != 3 {
+		t.Errorf("expected checksum tree to be read %d times, got %d", 3, cnt)
+	}
+
+	ft = &fakeTarget{name: "host", failing: `cat "$run"`, failures: 1}
+	if e := (&Build{Target: ft, Template: TemplateFunc(fleetTemplate)}).Run(); e == nil {
+		t.Errorf("expected non transient error not to be retried")
+	}
+}
+
+func TestRecordCommandRepeated(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	local, _ := NewLocalTarget()
+	store := &targetStateStore{}
+	b := &Build{Target: shellTarget{local}, CacheDir: dir}
+	if e := os.MkdirAll(filepath.Join(dir, "a"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	writeScript := func() {
+		if e := ioutil.WriteFile(filepath.Join(dir, "a", "x.sh"), []byte("echo x"), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	run := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := func() {
+		if e := store.RecordCommand(b, "a", "x", run, nil); e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+	}
+
+	// Recording again (as if retried) doesn't append another entry.
+	writeScript()
+	record()
+	record()
+	// The same command executed again does.
+	writeScript()
+	record()
+
+	content, e := ioutil.ReadFile(filepath.Join(dir, "a", "20240101_000000.run"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	done := filepath.Join(dir, "a", "x.done")
+	if lines := strings.Fields(string(content)); !reflect.DeepEqual(lines, []string{done, done}) {
+		t.Errorf("expected %d entries of %q, got %v", 2, done, lines)
+	}
+}
@@ -0,0 +1,211 @@
+package urknall
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const secretPrefix = "URKNALL_SECRET_"
+
+// Create a secret with the given name (letters, digits and underscores only)
+// and value, known to all builds. Panics if the name is invalid or a secret
+// with the same name, but another value exists. Use AddSecret for values that
+// differ between builds, e.g. per target of a MultiBuild.
+func NewSecret(name, value string) *Secret {
+	s := newSecret(name, value)
+	if e := secrets.register(s); e != nil {
+		panic(e.Error())
+	}
+	return s
+}
+
+// AddSecret creates a secret (see NewSecret) only known to the build rendering
+// the given package, while rendering its template. It takes precedence over a
+// secret of the same name created with NewSecret. Panics if the name is
+// invalid or the build knows a secret with the same name, but another value.
+func AddSecret(pkg Package, name, value string) *Secret {
+	p := mustPackage(pkg)
+	if p.secrets == nil {
+		p.secrets = newSecretRegistry(secrets)
+	}
+	s := newSecret(name, value)
+	if e := p.secrets.register(s); e != nil {
+		panic(e.Error())
+	}
+	return s
+}
+
+func newSecret(name, value string) *Secret {
+	if !validSecretName.MatchString(name) {
+		panic(fmt.Sprintf("invalid secret name %q (only letters, digits and '_' allowed)", name))
+	}
+	s := &Secret{name: name, value: value}
+	secretValues.add(value)
+	return s
+}
+
+// A secret is a value that must neither appear in logs nor in the scripts
+// stored on the target. Rendered (in templates or using fmt) a secret is a
+// reference to the environment variable $URKNALL_SECRET_<name>. Commands
+// referencing it get the variable set, with the value being sent on standard
+// input instead of being written to disk. Values of all secrets are masked in
+// log messages and the output of commands.
+//
+// The reference is expanded by the shell executing the command's script, so it
+// must not be used in single quotes or quoted here documents. Content not
+// interpreted by the shell (like the encoded content of a file written by a
+// command) keeps the literal reference. Write such files using the shell
+// instead, e.g. `printf '%s\n' "${URKNALL_SECRET_db}" > /etc/db.pass`. Using
+// the secret's Value in a command stores the value on the target.
+//
+// Checksums of commands only include the reference, i.e. changing a secret's
+// value doesn't execute cached commands again (see Build.Invalidate).
+type Secret struct {
+	name  string
+	value string
+}
+
+// The reference to the secret's environment variable.
+func (s *Secret) String() string {
+	return "${" + secretPrefix + s.name + "}"
+}
+
+// The secret's name.
+func (s *Secret) Name() string {
+	return s.name
+}
+
+// The secret's value. Handle with care, commands using it are stored on the
+// target.
+func (s *Secret) Value() string {
+	return s.value
+}
+
+var (
+	validSecretName  = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	secretReferences = regexp.MustCompile(secretPrefix + `([a-zA-Z0-9_]+)`)
+	secrets          = newSecretRegistry(nil) // created with NewSecret
+	secretValues     = &secretValueSet{known: map[string]bool{}}
+)
+
+const secretMask = "********"
+
+// A registry of secrets by name. Each build gets a registry of its own (see
+// AddSecret), falling back to the process wide one.
+type secretRegistry struct {
+	parent *secretRegistry // consulted for unknown names (nil for the process wide registry)
+
+	mutex  sync.RWMutex
+	byName map[string]*Secret
+}
+
+func newSecretRegistry(parent *secretRegistry) *secretRegistry {
+	return &secretRegistry{parent: parent, byName: map[string]*Secret{}}
+}
+
+func (r *secretRegistry) register(s *Secret) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, ok := r.byName[s.name]; ok && existing.value != s.value {
+		return fmt.Errorf("secret %q already exists with another value", s.name)
+	}
+	r.byName[s.name] = s
+	return nil
+}
+
+// lookup returns the secret with the given name from the registry or its
+// parents.
+func (r *secretRegistry) lookup(name string) (*Secret, bool) {
+	for ; r != nil; r = r.parent {
+		r.mutex.RLock()
+		s, ok := r.byName[name]
+		r.mutex.RUnlock()
+		if ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// referenced returns the secrets referenced in the given script. A nil
+// registry only knows the secrets created with NewSecret.
+func (r *secretRegistry) referenced(script string) ([]*Secret, error) {
+	if r == nil {
+		r = secrets
+	}
+	found := []*Secret{}
+	seen := map[string]bool{}
+	for _, m := range secretReferences.FindAllStringSubmatch(script, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		s, ok := r.lookup(m[1])
+		if !ok {
+			return nil, fmt.Errorf("script references unknown secret %q", m[1])
+		}
+		found = append(found, s)
+	}
+	return found, nil
+}
+
+// The values of all secrets created, that are masked in logs regardless of the
+// build they belong to.
+type secretValueSet struct {
+	mutex  sync.RWMutex
+	known  map[string]bool
+	sorted []string // longest first, so that no part of a value is left unmasked
+}
+
+func (v *secretValueSet) add(value string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if value == "" || v.known[value] {
+		return
+	}
+	v.known[value] = true
+	v.sorted = append(v.sorted, value)
+	sort.Sort(byLength(v.sorted))
+}
+
+type byLength []string
+
+func (l byLength) Len() int           { return len(l) }
+func (l byLength) Less(i, j int) bool { return len(l[i]) > len(l[j]) }
+func (l byLength) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// mask replaces the values of all secrets in the given string.
+func (v *secretValueSet) mask(s string) string {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	for _, value := range v.sorted {
+		if strings.Contains(s, value) {
+			s = strings.Replace(s, value, secretMask, -1)
+		}
+	}
+	return s
+}
+
+func maskSecrets(s string) string {
+	return secretValues.mask(s)
+}
+
+// withSecrets returns the command executing the script at the given path with
+// the given secrets set in its environment, and the stdin prelude that must be
+// sent before the command's input. The values are base64 encoded, one
+// variable per line, with an empty line marking the end of the prelude.
+func withSecrets(path string, list []*Secret) (string, io.Reader) {
+	prelude := &bytes.Buffer{}
+	for _, s := range list {
+		fmt.Fprintf(prelude, "%s%s=%s\n", secretPrefix, s.name, base64.StdEncoding.EncodeToString([]byte(s.value)))
+	}
+	prelude.WriteString("\n")
+	rawCmd := `sh -c 'while read -r line && [ -n "$line" ]; do export "${line%%=*}=$(printf %s "${line#*=}" | base64 -d)"; done; exec sh ` + path + `'`
+	return rawCmd, prelude
+}
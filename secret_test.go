@@ -0,0 +1,145 @@
+package urknall
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestSecretRendering(t *testing.T) {
+	s := NewSecret("db_password", "s3cr3t!")
+	if rendered := s.String(); rendered != "${URKNALL_SECRET_db_password}" {
+		t.Errorf("unexpected reference %q", rendered)
+	}
+
+	script := (&Build{}).renderScript(Shell("mysql -p"+s.String()+" -e 'select 1'"), nil)
+	if strings.Contains(script, "s3cr3t!") || !strings.Contains(script, "-p${URKNALL_SECRET_db_password}") {
+		t.Errorf("expected secret to be referenced, got %q", script)
+	}
+
+	// Values are only masked in logs, scripts are not changed.
+	NewSecret("admin_user", "admin")
+	if script := (&Build{}).renderScript(Shell("useradd admin"), nil); !strings.Contains(script, "useradd admin") {
+		t.Errorf("expected script not to be changed, got %q", script)
+	}
+
+	if masked := maskSecrets("+ mysql -ps3cr3t!"); masked != "+ mysql -p"+secretMask {
+		t.Errorf("expected secret to be masked, got %q", masked)
+	}
+	if msg := (&commandWrapper{command: Shell("echo s3cr3t!")}).LogMsg(); msg != "echo "+secretMask {
+		t.Errorf("expected log message to be masked, got %q", msg)
+	}
+
+	if _, e := secrets.referenced("echo $URKNALL_SECRET_unknown"); e == nil {
+		t.Errorf("expected error for unknown secret")
+	}
+}
+
+func TestSecretDelivery(t *testing.T) {
+	s := NewSecret("api_token", "to ken=\"x'")
+	script, e := ioutil.TempFile("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer script.Close()
+	script.WriteString("echo \"$URKNALL_SECRET_api_token\"\ncat\n")
+
+	referenced, e := secrets.referenced("$URKNALL_SECRET_api_token")
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	rawCmd, prelude := withSecrets(script.Name(), referenced)
+	if strings.Contains(rawCmd, s.Value()) {
+		t.Errorf("expected secret not to be part of the command, got %q", rawCmd)
+	}
+	c := exec.Command("sh", "-c", rawCmd)
+	c.Stdin = io.MultiReader(prelude, strings.NewReader("input\n"))
+	out, e := c.CombinedOutput()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q: %s", e, out)
+	}
+	if expected := s.Value() + "\ninput\n"; string(out) != expected {
+		t.Errorf("expected output %q, got %q", expected, out)
+	}
+}
+
+func TestBuildSecretsNotStored(t *testing.T) {
+	s := NewSecret("build_password", "hunter2")
+	ft := &fakeTarget{name: "host"}
+	tpl := TemplateFunc(func(pkg Package) {
+		pkg.AddCommands("base", Shell("echo "+s.String()))
+	})
+	if e := (&Build{Target: ft, Template: tpl}).Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "hunter2"); cnt != 0 {
+		t.Errorf("expected secret not to be sent in commands, got %d", cnt)
+	}
+	if cnt := countCommands(ft, "exec sh "+ukCACHEDIR+"/base/"); cnt != 1 {
+		t.Errorf("expected script to be executed with secrets, got %d", cnt)
+	}
+}
+
+func TestSecretChecksum(t *testing.T) {
+	old, rotated := &Secret{name: "rotated", value: "old"}, &Secret{name: "rotated", value: "new"}
+	before, _ := checksumWith(Shell("echo "+old.String()), []string{"PASS=" + old.String()}, nil)
+	after, _ := checksumWith(Shell("echo "+rotated.String()), []string{"PASS=" + rotated.String()}, nil)
+	if before != after {
+		t.Errorf("expected checksum not to depend on the secret's value, got %q and %q", before, after)
+	}
+}
+
+func TestSecretRedefined(t *testing.T) {
+	NewSecret("redefined", "one")
+	NewSecret("redefined", "one")
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected creating a secret with another value to panic")
+		}
+	}()
+	NewSecret("redefined", "two")
+}
+
+type perTargetSecretTemplate struct {
+	password string
+}
+
+func (tpl *perTargetSecretTemplate) Render(pkg Package) {
+	s := AddSecret(pkg, "target_password", tpl.password)
+	pkg.AddCommands("base", Shell("echo "+s.String()))
+}
+
+func TestBuildSecretsPerBuild(t *testing.T) {
+	targets := []*fakeTarget{{name: "one"}, {name: "two"}}
+	passwords := []string{"first", "second"}
+	errs := make(chan error, len(targets))
+	for i := range targets {
+		go func(ft *fakeTarget, password string) {
+			errs <- (&Build{Target: ft, Template: &perTargetSecretTemplate{password: password}}).Run()
+		}(targets[i], passwords[i])
+	}
+	for range targets {
+		if e := <-errs; e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+	}
+
+	for i, ft := range targets {
+		expected := "URKNALL_SECRET_target_password=" + base64.StdEncoding.EncodeToString([]byte(passwords[i])) + "\n"
+		found := false
+		for cmd, in := range ft.inputs {
+			if strings.HasSuffix(cmd, ".sh'") && strings.Contains(in, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected target %q to receive its own secret, got %q", ft.name, ft.inputs)
+		}
+	}
+	if _, ok := secrets.lookup("target_password"); ok {
+		t.Errorf("expected secret not to be known outside of its build")
+	}
+}
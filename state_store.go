@@ -0,0 +1,397 @@
+package urknall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/megamsys/urknall/target"
+)
+
+// A StateStore keeps track of the commands executed on a target. Urknall uses
+// the state to decide which commands are cached, i.e. must not be executed
+// again. Each method is given the build it is called for, so that a single
+// store can be shared by many builds (see MultiBuild).
+//
+// The default store keeps the state on the target's file system (see
+// Build.State). The JSONStateStore keeps it on the controlling host.
+type StateStore interface {
+	// Prepare the store for the given build. This is called once per build,
+	// before any other method.
+	Prepare(b *Build) error
+
+	// Return the checksums of the commands executed successfully in the last
+	// run of each task (in execution order).
+	ChecksumTree(b *Build) (map[string][]string, error)
+
+	// Prepare the store for a task not known yet.
+	PrepareTask(b *Build, task string) error
+
+	// Store the script of the given command and return the path on the
+	// target it can be executed from.
+	WriteScript(b *Build, task, checksum, script string) (path string, e error)
+
+	// Return a writer for the output of the given command. The writer is
+	// closed after the command finished.
+	LogWriter(b *Build, task, checksum string) (io.WriteCloser, error)
+
+	// Record the result of the given command. The run identifies the task's
+	// run the command was executed in. Cached commands are recorded too.
+	RecordCommand(b *Build, task, checksum string, run time.Time, err error) error
+
+	// Return the script of a command executed previously.
+	Script(b *Build, task, checksum string) (string, error)
+}
+
+var defaultStateStore StateStore = &targetStateStore{}
+
+// The targetStateStore keeps the state in the build's cache directory on the
+// target (see Build.CacheDir and Build.Namespace). There is a directory for
+// each task containing the scripts (<checksum>.sh while running,
+// <checksum>.done or <checksum>.failed afterwards), their output
+// (<checksum>.log) and a file for each run of the task (<timestamp>.run) that
+// lists the files of the commands executed.
+type targetStateStore struct {
+}
+
+func (s *targetStateStore) taskDir(build *Build, task string) string {
+	return build.cacheDir() + "/" + task
+}
+
+func (s *targetStateStore) Prepare(build *Build) error {
+	cacheDir, group := build.cacheDir(), build.cacheGroup()
+	rawCmd := fmt.Sprintf(`{ grep "^%s:" /etc/group | grep %s; } && [ -d %[3]s ] && [ -f %[3]s/.v2 ]`,
+		group, build.User(), cacheDir)
+	cmd, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return e
+	}
+	if e := cmd.Run(); e != nil {
+		// If user is missing the group, create group (if necessary), add user and restart ssh connection.
+		cmds := []string{
+			fmt.Sprintf(`{ grep -e '^%[1]s:' /etc/group > /dev/null || { groupadd %[1]s; }; }`, group),
+			// The directory might have been created by the lock already (see Lock).
+			fmt.Sprintf(`mkdir -p %[1]s && chgrp %[2]s %[1]s && chmod 2775 %[1]s`, cacheDir, group),
+			fmt.Sprintf("usermod -a -G %s %s", group, build.User()),
+			fmt.Sprintf(`[ -f %[1]s/.v2 ] || { export DATE=$(date "+%%Y%%m%%d_%%H%%M%%S") && ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.done | tac > %[1]s/$dir/$DATE.run; done && touch %[1]s/.v2;  } `, cacheDir),
+		}
+
+		cmd, e = build.prepareInternalCommand(strings.Join(cmds, " && "))
+		if e != nil {
+			return e
+		}
+		out := &bytes.Buffer{}
+		err := &bytes.Buffer{}
+		cmd.SetStderr(err)
+		cmd.SetStdout(out)
+		if e := cmd.Run(); e != nil {
+			return fmt.Errorf("failed to initiate user %q for provisioning: %s, out=%q err=%q", build.User(), e, out.String(), err.String())
+		}
+		return build.Reset()
+	}
+	return nil
+}
+
+func (s *targetStateStore) ChecksumTree(build *Build) (map[string][]string, error) {
+	ct := map[string][]string{}
+	cacheDir := build.cacheDir()
+
+	// Directories without run files are skipped, as they aren't tasks. The
+	// caches of namespaces are hidden (see Build.Namespace).
+	rawCmd := fmt.Sprintf(
+		`[ -d %[1]s ] && { for dir in %[1]s/*/; do run=$(ls -t "$dir"*.run 2>/dev/null | head -n1); if [ -n "$run" ]; then cat "$run"; fi; done; }`,
+		cacheDir)
+	cmd, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return nil, e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+
+	cmd.SetStdout(out)
+	cmd.SetStderr(err)
+
+	if e := cmd.Run(); e != nil {
+		return nil, fmt.Errorf("%s: out=%s err=%s", e.Error(), out.String(), err.String())
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || !strings.HasSuffix(line, ".done") {
+			continue
+		}
+
+		pkgname := filepath.Dir(strings.TrimPrefix(line, cacheDir+"/"))
+		checksum := strings.TrimSuffix(filepath.Base(line), ".done")
+		if len(checksum) != 64 {
+			return nil, fmt.Errorf("invalid checksum %q found for package %q", checksum, pkgname)
+		}
+		ct[pkgname] = append(ct[pkgname], checksum)
+	}
+
+	return ct, nil
+}
+
+func (s *targetStateStore) PrepareTask(build *Build, task string) error {
+	// Create checksum dir and set group bit (all new files will inherit the directory's group). This allows for
+	// different users (being part of that group) to create, modify and delete the contained checksum and log files.
+	createChecksumDirCmd := fmt.Sprintf("mkdir -m2775 -p %s", s.taskDir(build, task))
+
+	cmd, e := build.prepareInternalCommand(createChecksumDirCmd)
+	if e != nil {
+		return e
+	}
+	err := &bytes.Buffer{}
+
+	cmd.SetStderr(err)
+
+	if e := cmd.Run(); e != nil {
+		return fmt.Errorf("%s: %s", err.String(), e.Error())
+	}
+	return nil
+}
+
+func (s *targetStateStore) WriteScript(build *Build, task, checksum, script string) (string, error) {
+	targetFile := s.taskDir(build, task) + "/" + checksum + ".sh"
+	rawCmd := fmt.Sprintf("cat <<\"EOSCRIPT\" > %s\n%s\nEOSCRIPT\n", targetFile, script)
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return "", e
+	}
+
+	return targetFile, c.Run()
+}
+
+func (s *targetStateStore) LogWriter(build *Build, task, checksum string) (io.WriteCloser, error) {
+	path := s.taskDir(build, task) + "/" + checksum + ".log"
+	// so ugly, but: sudo not required and "sh -c" adds some escaping issues with the variables. This is why Command is called directly.
+	cmd, err := build.Command("cat - > " + path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get pipe to stdin of the execute command.
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Run command, writing everything coming from stdin to a file.
+	if err := cmd.Start(); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &commandWriter{WriteCloser: in, cmd: cmd}, nil
+}
+
+// RecordCommand will manage the log of run commands in a file. This file gets append the path to a file
+// for each command, that contains the executed script. The filename contains either ".done" or ".failed" as
+// suffix, depending on the err given (nil or not).
+//
+// The command might be retried if only its exit status was lost (see
+// internalCommand), so the file is only appended again if the script was
+// written again (e.g. for a task running the same command twice).
+func (s *targetStateStore) RecordCommand(build *Build, task, checksum string, run time.Time, err error) error {
+	checksumDir := s.taskDir(build, task)
+	prefix := checksumDir + "/" + checksum
+	sourceFile := prefix + ".sh"
+	targetFile := prefix + ".done"
+	if err != nil {
+		targetFile = prefix + ".failed"
+	}
+	runFile := fmt.Sprintf("%s/%s.run", checksumDir, run.Format("20060102_150405"))
+	rawCmd := fmt.Sprintf(`if [ -f %[2]s ]; then mv -f %[2]s %[1]s && echo %[1]s >> %[3]s; elif [ "$(tail -n 1 %[3]s 2>/dev/null)" != %[1]s ]; then echo %[1]s >> %[3]s; fi`,
+		targetFile, sourceFile, runFile)
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return e
+	}
+
+	return c.Run()
+}
+
+// The pending handlers are kept in the cache directory's .handlers file.
+func (s *targetStateStore) PendingHandlers(build *Build) ([]string, error) {
+	path := build.cacheDir() + "/.handlers"
+	c, e := build.prepareInternalCommand(fmt.Sprintf("[ ! -f %[1]s ] || cat %[1]s", path))
+	if e != nil {
+		return nil, e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return nil, fmt.Errorf("failed to read pending handlers %q: %s err=%q", path, e, err.String())
+	}
+	names := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+func (s *targetStateStore) SetPendingHandlers(build *Build, names []string) error {
+	path := build.cacheDir() + "/.handlers"
+	rawCmd := "rm -f " + path
+	if len(names) > 0 {
+		quoted := make([]string, 0, len(names))
+		for _, name := range names {
+			quoted = append(quoted, shellQuote(name))
+		}
+		rawCmd = fmt.Sprintf(`printf '%%s\n' %[2]s > %[1]s.tmp && mv %[1]s.tmp %[1]s`, path, strings.Join(quoted, " "))
+	}
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return e
+	}
+	err := &bytes.Buffer{}
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return fmt.Errorf("failed to write pending handlers %q: %s err=%q", path, e, err.String())
+	}
+	return nil
+}
+
+func (s *targetStateStore) Script(build *Build, task, checksum string) (string, error) {
+	path := s.taskDir(build, task) + "/" + checksum + ".done"
+	c, e := build.prepareInternalCommand("cat " + path)
+	if e != nil {
+		return "", e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return "", fmt.Errorf("failed to read script %q: %s err=%q", path, e, err.String())
+	}
+	return out.String(), nil
+}
+
+// A commandWriter writes to the standard input of a started command. Closing
+// the writer will wait for the command to finish.
+type commandWriter struct {
+	io.WriteCloser
+	cmd target.ExecCommand
+}
+
+func (w *commandWriter) Close() error {
+	if e := w.WriteCloser.Close(); e != nil {
+		return e
+	}
+	return w.cmd.Wait()
+}
+
+func (s *targetStateStore) Prune(build *Build, tasks []string, policy *RetentionPolicy) ([]string, error) {
+	listing, e := s.listCache(build)
+	if e != nil {
+		return nil, e
+	}
+
+	known := map[string]bool{}
+	for _, t := range tasks {
+		known[t] = true
+	}
+
+	removed := []string{}
+	for _, task := range sortedKeys(listing) {
+		if policy.RemoveUnknownTasks && !known[task] {
+			removed = append(removed, task+"/")
+			continue
+		}
+		for _, f := range policy.prunable(listing[task], time.Now()) {
+			removed = append(removed, task+"/"+f)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	args := make([]string, 0, len(removed))
+	for _, r := range removed {
+		args = append(args, shellQuote(r))
+	}
+	c, e := build.prepareInternalCommand(fmt.Sprintf("cd %s && rm -rf -- %s", build.cacheDir(), strings.Join(args, " ")))
+	if e != nil {
+		return nil, e
+	}
+	err := &bytes.Buffer{}
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return nil, fmt.Errorf("failed to remove cache entries: %s err=%q", e, err.String())
+	}
+	return removed, nil
+}
+
+// listCache returns the files of all task directories in the cache and the
+// content of the contained run files. Only directories containing files are
+// tasks. The caches of namespaces are hidden (see Build.Namespace).
+func (s *targetStateStore) listCache(build *Build) (map[string]*cacheTaskListing, error) {
+	rawCmd := fmt.Sprintf(`[ -d %[1]s ] || exit 0
+cd %[1]s
+for dir in *; do
+  if [ ! -d "$dir" ]; then continue; fi
+  for f in "$dir"/*; do if [ -f "$f" ]; then echo "file $f"; fi; done
+  for r in "$dir"/*.run; do if [ -f "$r" ]; then sed "s|^|run $r |" "$r"; fi; done
+done`, build.cacheDir())
+	c, e := build.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return nil, e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return nil, fmt.Errorf("failed to list cache: %s err=%q", e, err.String())
+	}
+	return parseCacheListing(out.String()), nil
+}
+
+func parseCacheListing(out string) map[string]*cacheTaskListing {
+	listing := map[string]*cacheTaskListing{}
+	task := func(name string) *cacheTaskListing {
+		if _, ok := listing[name]; !ok {
+			listing[name] = &cacheTaskListing{runs: map[string][]string{}}
+		}
+		return listing[name]
+	}
+	split := func(path string) (string, string) {
+		i := strings.LastIndex(path, "/")
+		return path[:i], path[i+1:]
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "file" && strings.Contains(fields[1], "/"):
+			dir, name := split(fields[1])
+			task(dir).files = append(task(dir).files, name)
+		case len(fields) == 3 && fields[0] == "run" && strings.Contains(fields[1], "/"):
+			dir, name := split(fields[1])
+			task(dir).runs[name] = append(task(dir).runs[name], fields[2])
+		}
+	}
+	return listing
+}
+
+func sortedKeys(m map[string]*cacheTaskListing) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
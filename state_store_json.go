@@ -0,0 +1,348 @@
+package urknall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Create a state store that keeps the state in the JSON file at the given path.
+func NewJSONStateStore(path string) *JSONStateStore {
+	return &JSONStateStore{Path: path}
+}
+
+// A JSONStateStore keeps the state on the controlling host in a JSON file.
+// This allows for incremental provisioning of targets where urknall's cache
+// directory can't be written (immutable images for example). The scripts are
+// still copied to the target for execution, each to a private directory
+// (created with mktemp in ScriptDir) that is removed after the script ran.
+//
+// The store can be shared by many builds, as the state is kept per hostname
+// (and namespace, see Build.Namespace).
+//
+// The store doesn't implement Locker, i.e. targets are not locked for builds
+// using it. Concurrent builds on the same target must be prevented otherwise.
+type JSONStateStore struct {
+	Path      string // Path of the JSON file.
+	ScriptDir string // Directory on the target the scripts' private directories are created in (/tmp if empty).
+	LogDir    string // Local directory the output of commands is written to (discarded if empty).
+
+	mutex   sync.Mutex
+	hosts   map[string]*jsonHostState
+	scripts map[jsonScriptKey]string // private directories of the scripts written, until the command is recorded
+}
+
+type jsonScriptKey struct {
+	build          *Build
+	task, checksum string
+}
+
+type jsonHostState struct {
+	Tasks    map[string]*jsonTaskState `json:"tasks"`
+	Handlers []string                  `json:"handlers,omitempty"` // Triggered handlers not executed yet.
+}
+
+type jsonTaskState struct {
+	Runs    []*jsonRun        `json:"runs"`
+	Scripts map[string]string `json:"scripts"` // Scripts by checksum.
+}
+
+type jsonRun struct {
+	Started  time.Time      `json:"started"`
+	Commands []*jsonCommand `json:"commands"`
+}
+
+type jsonCommand struct {
+	Checksum string `json:"checksum"`
+	Failed   bool   `json:"failed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (s *JSONStateStore) Prepare(b *Build) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.hosts != nil {
+		return nil
+	}
+	s.hosts = map[string]*jsonHostState{}
+	content, e := ioutil.ReadFile(s.Path)
+	switch {
+	case os.IsNotExist(e):
+		return nil
+	case e != nil:
+		return e
+	}
+	if e = json.Unmarshal(content, &s.hosts); e != nil {
+		return fmt.Errorf("failed to parse state file %q: %s", s.Path, e)
+	}
+	return nil
+}
+
+func (s *JSONStateStore) ChecksumTree(b *Build) (map[string][]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ct := map[string][]string{}
+	for name, task := range s.host(b).Tasks {
+		if len(task.Runs) == 0 {
+			continue
+		}
+		checksums := []string{}
+		for _, c := range task.Runs[len(task.Runs)-1].Commands {
+			if !c.Failed {
+				checksums = append(checksums, c.Checksum)
+			}
+		}
+		ct[name] = checksums
+	}
+	return ct, nil
+}
+
+func (s *JSONStateStore) PrepareTask(b *Build, task string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.task(b, task)
+	return nil
+}
+
+// WriteScript writes the script to a directory created with mktemp (i.e.
+// with mode 0700, owned by root or the build's become user), so that other
+// users on the target can neither read nor replace it. The directory is
+// removed when the command is recorded.
+func (s *JSONStateStore) WriteScript(b *Build, task, checksum, script string) (string, error) {
+	parent := s.ScriptDir
+	if parent == "" {
+		parent = "/tmp"
+	}
+	// The template's commands run as the become user, that must own the script.
+	chown := ""
+	if b.BecomeUser != "" {
+		chown = " && chown -R " + shellQuote(b.BecomeUser) + " $dir"
+	}
+	rawCmd := fmt.Sprintf("mkdir -p %[1]s && dir=$(mktemp -d %[1]s/urknall.XXXXXXXXXX) && cat <<\"EOSCRIPT\" > $dir/%[2]s.sh%[4]s && echo $dir\n%[3]s\nEOSCRIPT\n",
+		shellQuote(parent), checksum, script, chown)
+	c, e := b.prepareInternalCommand(rawCmd)
+	if e != nil {
+		return "", e
+	}
+	out := &bytes.Buffer{}
+	err := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStderr(err)
+	if e = c.Run(); e != nil {
+		return "", fmt.Errorf("failed to write script: %s err=%q", e, err.String())
+	}
+	dir := strings.TrimSpace(out.String())
+	if !strings.HasPrefix(dir, strings.TrimSuffix(parent, "/")+"/urknall.") {
+		return "", fmt.Errorf("failed to create script directory in %q: got %q", parent, dir)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.task(b, task).Scripts[checksum] = script + "\n"
+	if s.scripts == nil {
+		s.scripts = map[jsonScriptKey]string{}
+	}
+	s.scripts[jsonScriptKey{b, task, checksum}] = dir
+	return dir + "/" + checksum + ".sh", nil
+}
+
+// removeScript removes the private directory of the given command's script,
+// if one was written.
+func (s *JSONStateStore) removeScript(b *Build, task, checksum string) error {
+	s.mutex.Lock()
+	key := jsonScriptKey{b, task, checksum}
+	dir, ok := s.scripts[key]
+	delete(s.scripts, key)
+	s.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	c, e := b.prepareInternalCommand("rm -rf -- " + shellQuote(dir))
+	if e != nil {
+		return e
+	}
+	err := &bytes.Buffer{}
+	c.SetStderr(err)
+	if e := c.Run(); e != nil {
+		return fmt.Errorf("failed to remove script directory %q: %s err=%q", dir, e, err.String())
+	}
+	return nil
+}
+
+func (s *JSONStateStore) LogWriter(b *Build, task, checksum string) (io.WriteCloser, error) {
+	if s.LogDir == "" {
+		return nopWriteCloser{ioutil.Discard}, nil
+	}
+	dir := filepath.Join(s.LogDir, b.hostname(), task)
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return nil, e
+	}
+	return os.Create(filepath.Join(dir, checksum+".log"))
+}
+
+func (s *JSONStateStore) RecordCommand(b *Build, task, checksum string, run time.Time, err error) error {
+	// Failing to remove the script doesn't affect the command's result.
+	if e := s.removeScript(b, task, checksum); e != nil {
+		logError(e)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ts := s.task(b, task)
+	var r *jsonRun
+	if len(ts.Runs) > 0 && ts.Runs[len(ts.Runs)-1].Started.Equal(run) {
+		r = ts.Runs[len(ts.Runs)-1]
+	} else {
+		r = &jsonRun{Started: run}
+		ts.Runs = append(ts.Runs, r)
+	}
+
+	c := &jsonCommand{Checksum: checksum}
+	if err != nil {
+		c.Failed, c.Error = true, err.Error()
+	}
+	r.Commands = append(r.Commands, c)
+	return s.save()
+}
+
+func (s *JSONStateStore) Script(b *Build, task, checksum string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	script, ok := s.task(b, task).Scripts[checksum]
+	if !ok {
+		return "", fmt.Errorf("no script with checksum %q found for task %q", checksum, task)
+	}
+	return script, nil
+}
+
+func (s *JSONStateStore) PendingHandlers(b *Build) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string{}, s.host(b).Handlers...), nil
+}
+
+func (s *JSONStateStore) SetPendingHandlers(b *Build, names []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.host(b).Handlers = append([]string{}, names...)
+	return s.save()
+}
+
+func (s *JSONStateStore) host(b *Build) *jsonHostState {
+	key := b.hostname()
+	if b.Namespace != "" {
+		key += "/" + b.Namespace
+	}
+	h, ok := s.hosts[key]
+	if !ok {
+		h = &jsonHostState{Tasks: map[string]*jsonTaskState{}}
+		s.hosts[key] = h
+	}
+	return h
+}
+
+func (s *JSONStateStore) task(b *Build, name string) *jsonTaskState {
+	h := s.host(b)
+	t, ok := h.Tasks[name]
+	if !ok {
+		t = &jsonTaskState{Scripts: map[string]string{}}
+		h.Tasks[name] = t
+	}
+	return t
+}
+
+// save writes the state to a temporary file, that is renamed afterwards, so
+// that the state file is never left half written.
+func (s *JSONStateStore) save() error {
+	content, e := json.MarshalIndent(s.hosts, "", "  ")
+	if e != nil {
+		return e
+	}
+	tmp := s.Path + ".tmp"
+	if e = ioutil.WriteFile(tmp, content, 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (s *JSONStateStore) Prune(b *Build, tasks []string, policy *RetentionPolicy) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	known := map[string]bool{}
+	for _, t := range tasks {
+		known[t] = true
+	}
+
+	h := s.host(b)
+	names := make([]string, 0, len(h.Tasks))
+	for name := range h.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	removed := []string{}
+	for _, name := range names {
+		if policy.RemoveUnknownTasks && !known[name] {
+			delete(h.Tasks, name)
+			removed = append(removed, name+"/")
+			continue
+		}
+
+		ts := h.Tasks[name]
+		times := make([]time.Time, len(ts.Runs))
+		for i := range ts.Runs {
+			times[i] = ts.Runs[len(ts.Runs)-1-i].Started
+		}
+		keep := policy.keep(times, time.Now())
+
+		runs := []*jsonRun{}
+		referenced := map[string]bool{}
+		for i, r := range ts.Runs {
+			if !keep[len(ts.Runs)-1-i] {
+				removed = append(removed, name+"/"+r.Started.Format("20060102_150405")+".run")
+				continue
+			}
+			runs = append(runs, r)
+			for _, c := range r.Commands {
+				referenced[c.Checksum] = true
+			}
+		}
+		ts.Runs = runs
+
+		for checksum := range ts.Scripts {
+			if !referenced[checksum] {
+				delete(ts.Scripts, checksum)
+				removed = append(removed, name+"/"+checksum+".sh")
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, s.save()
+}
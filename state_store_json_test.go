@@ -0,0 +1,57 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONStateStore(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	ft := &fakeTarget{name: "host"}
+	b := &Build{Target: ft, Template: TemplateFunc(planTemplate), State: NewJSONStateStore(path)}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+
+	for _, c := range ft.commands {
+		if strings.Contains(c, ukCACHEDIR) {
+			t.Errorf("didn't expect the cache directory to be used, got command %q", c)
+		}
+	}
+	// Scripts are executed from a private directory, that is removed afterwards.
+	if cnt := countCommands(ft, "sh /tmp/urknall.fake/"); cnt != 2 {
+		t.Errorf("expected %d scripts to be executed from the private directory, got %d", 2, cnt)
+	}
+	if cnt := countCommands(ft, "rm -rf -- '/tmp/urknall.fake'"); cnt != 2 {
+		t.Errorf("expected the private directory to be removed %d times, got %d", 2, cnt)
+	}
+
+	// A new store reading the same file must find all commands cached.
+	b.State = NewJSONStateStore(path)
+	plan, e := b.Plan()
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if plan.Tasks[0].CacheBreak != -1 {
+		t.Errorf("expected all commands to be cached, cache broke at %d", plan.Tasks[0].CacheBreak)
+	}
+
+	// The private directory is handed to the become user.
+	ft = &fakeTarget{name: "host"}
+	b = &Build{Target: ft, Template: TemplateFunc(planTemplate), State: NewJSONStateStore(filepath.Join(dir, "app.json")), BecomeUser: "app"}
+	if e := b.Run(); e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if cnt := countCommands(ft, "chown -R 'app' $dir"); cnt != 2 {
+		t.Errorf("expected the private directory to be owned by the become user %d times, got %d", 2, cnt)
+	}
+}
@@ -14,21 +14,28 @@ type Target interface {
 // Create an SSH target. The address is an identifier of the form
 // `[<user>@?]<host>[:port]`. It is assumed that authentication via public key
 // will work, i.e. the remote host has the building user's public key in its
-// authorized_keys file.
-func NewSshTarget(address string) (Target, error) {
-	return target.NewSshTarget(address)
+// authorized_keys file. The host's key is verified using ~/.ssh/known_hosts,
+// see the target package's options (e.g. target.TrustOnFirstUse) for
+// alternatives.
+//
+// Hosts behind jump hosts are given by prefixing the address with those,
+// separated by ">" (e.g. `ops@bastion>app@10.0.0.5`), or using the
+// target.JumpHost option.
+func NewSshTarget(address string, opts ...target.SshOption) (Target, error) {
+	return target.NewSshTarget(address, opts...)
 }
 
-// Create a SSH target with a private access key
-func NewSshTargetWithPrivateKey(address string, key []byte) (Target, error) {
-	return target.NewSshTargetWithPrivateKey(address, key)
+// Create a SSH target with a private access key. Encrypted keys require the
+// target.Passphrase (or target.PassphraseCallback) option.
+func NewSshTargetWithPrivateKey(address string, key []byte, opts ...target.SshOption) (Target, error) {
+	return target.NewSshTargetWithPrivateKey(address, key, opts...)
 }
 
 // Special SSH target that uses the given password for accessing the machine.
 // This is required mostly for testing and shouldn't be used in production
 // settings.
-func NewSshTargetWithPassword(address, password string) (Target, error) {
-	target, e := target.NewSshTarget(address)
+func NewSshTargetWithPassword(address, password string, opts ...target.SshOption) (Target, error) {
+	target, e := target.NewSshTarget(address, opts...)
 	if e == nil {
 		target.Password = password
 	}
@@ -1,6 +1,15 @@
 package target
 
-import "io"
+import (
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
 
 type ExecCommand interface {
 	StdoutPipe() (io.Reader, error)
@@ -13,3 +22,63 @@ type ExecCommand interface {
 	Start() error
 	Wait() error
 }
+
+// Commands implementing the Interrupter interface can be killed while running,
+// for example if the build they belong to is cancelled. A pending Wait call
+// must return after Interrupt was called.
+//
+// The targets of this package send the TERM signal first, which sudo passes
+// on to the command, and kill the command after a grace period.
+type Interrupter interface {
+	Interrupt() error
+}
+
+// How long an interrupted command may take to terminate before it is killed.
+const interruptGracePeriod = 5 * time.Second
+
+// ExitStatus returns the exit status of a command that failed with the given
+// error, if the error is caused by the command exiting with a non-zero status.
+func ExitStatus(e error) (int, bool) {
+	switch err := e.(type) {
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			return status.ExitStatus(), true
+		}
+	case *ssh.ExitError:
+		if err.Signal() == "" {
+			return err.ExitStatus(), true
+		}
+	}
+	return 0, false
+}
+
+// ExitSignal returns the name of the signal a command was killed with, if the
+// given error is caused by that.
+func ExitSignal(e error) (string, bool) {
+	switch err := e.(type) {
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return status.Signal().String(), true
+		}
+	case *ssh.ExitError:
+		if err.Signal() != "" {
+			return err.Signal(), true
+		}
+	}
+	return "", false
+}
+
+// IsTransient returns whether the given error is caused by the connection to
+// the target rather than by the executed command, i.e. whether executing the
+// command again might succeed.
+func IsTransient(e error) bool {
+	switch err := e.(type) {
+	case nil:
+		return false
+	case net.Error, *ssh.OpenChannelError:
+		return true
+	default:
+		return err == io.EOF || err == io.ErrUnexpectedEOF ||
+			strings.Contains(err.Error(), "remote command exited without exit status or exit signal")
+	}
+}
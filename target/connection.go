@@ -0,0 +1,177 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// Abort connecting (including the SSH handshake) after the given duration
+// (30 seconds by default, no timeout if 0).
+func DialTimeout(timeout time.Duration) SshOption {
+	return func(t *sshTarget) error {
+		t.dialTimeout = timeout
+		return nil
+	}
+}
+
+// Send keepalive requests in the given interval (30 seconds by default,
+// disabled if 0). This keeps idle connections from being dropped (e.g. by a
+// NAT) and detects broken ones: connections not answering a request within
+// the interval are closed and replaced when the next command is created.
+func KeepAlive(interval time.Duration) SshOption {
+	return func(t *sshTarget) error {
+		t.keepAlive = interval
+		return nil
+	}
+}
+
+// An SSH client that knows whether its connection is closed.
+type sshClient struct {
+	*ssh.Client
+	closed chan struct{} // closed once the connection is closed
+}
+
+func newSshClient(client *ssh.Client, keepAlive time.Duration) *sshClient {
+	c := &sshClient{Client: client, closed: make(chan struct{})}
+	go func() {
+		client.Wait()
+		close(c.closed)
+	}()
+	if keepAlive > 0 {
+		go c.sendKeepAlives(keepAlive)
+	}
+	return c
+}
+
+func (c *sshClient) alive() bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// sendKeepAlives sends keepalive requests until the connection is closed. The
+// connection is closed if a request fails or isn't answered in time.
+func (c *sshClient) sendKeepAlives(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.probe(interval) {
+			c.Close()
+			return
+		}
+	}
+}
+
+// probe sends a keepalive request and returns whether it is answered within
+// the given timeout. Any answer will do, as servers not knowing the request
+// reply with a failure.
+func (c *sshClient) probe(timeout time.Duration) bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, e := c.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- e
+	}()
+	select {
+	case e := <-replied:
+		return e == nil
+	case <-time.After(timeout):
+		return false
+	case <-c.closed:
+		return false
+	}
+}
+
+// connectVia connects to the target's host through the given client (directly
+// if nil), aborting after the target's dial timeout.
+func (target *sshTarget) connectVia(via *sshClient) (*sshClient, error) {
+	config, closeAgent, e := target.clientConfig()
+	if e != nil {
+		return nil, e
+	}
+	defer closeAgent()
+	addr := target.hostPort()
+
+	var conn net.Conn
+	if via == nil {
+		conn, e = net.DialTimeout("tcp", addr, target.dialTimeout)
+	} else {
+		conn, e = dialVia(via, addr, target.dialTimeout)
+	}
+	if e != nil {
+		return nil, e
+	}
+
+	// Connections through jump hosts don't support deadlines, so the
+	// handshake is aborted by closing the connection.
+	var timer *time.Timer
+	if target.dialTimeout > 0 {
+		timer = time.AfterFunc(target.dialTimeout, func() { conn.Close() })
+	}
+	c, chans, reqs, e := ssh.NewClientConn(conn, addr, config)
+	if timer != nil && !timer.Stop() {
+		if e == nil {
+			c.Close()
+		}
+		return nil, &timeoutError{fmt.Sprintf("ssh handshake with %s timed out after %s", addr, target.dialTimeout)}
+	}
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	return newSshClient(ssh.NewClient(c, chans, reqs), target.keepAlive), nil
+}
+
+// dialVia opens a connection to the given address through the client, which
+// is aborted after the given timeout (if greater than 0).
+func dialVia(via *sshClient, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return via.Dial("tcp", addr)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, e := via.Dial("tcp", addr)
+		result <- dialed{conn, e}
+	}()
+	select {
+	case d := <-result:
+		return d.conn, d.err
+	case <-time.After(timeout):
+		go func() {
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, &timeoutError{fmt.Sprintf("dialing %s timed out after %s", addr, timeout)}
+	}
+}
+
+// timeoutError is a net.Error, so that timeouts are considered transient (see
+// IsTransient).
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,205 @@
+package target
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SSH server accepting sessions, but ignoring all other
+// requests (i.e. keepalives are never answered).
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mutex       sync.Mutex
+	conns       []*ssh.ServerConn
+	maxSessions int // per connection, sessions beyond are refused (no limit if 0)
+}
+
+func newTestServer(t *testing.T) *testServer {
+	priv, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	signer, e := ssh.NewSignerFromKey(priv)
+	if e != nil {
+		t.Fatal(e)
+	}
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := &testServer{listener: l, config: &ssh.ServerConfig{NoClientAuth: true}}
+	s.config.AddHostKey(signer)
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, e := s.listener.Accept()
+		if e != nil {
+			return
+		}
+		go func() {
+			c, chans, reqs, e := ssh.NewServerConn(conn, s.config)
+			if e != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns = append(s.conns, c)
+			maxSessions := s.maxSessions
+			s.mutex.Unlock()
+			go func() {
+				for range reqs {
+				}
+			}()
+			sessions := 0
+			for ch := range chans {
+				if maxSessions > 0 && sessions >= maxSessions {
+					ch.Reject(ssh.ResourceShortage, "too many sessions")
+					continue
+				}
+				sessions++
+				if ch, _, e := ch.Accept(); e == nil {
+					defer ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func (s *testServer) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func newTestTarget(t *testing.T, addr string, opts ...SshOption) *sshTarget {
+	opts = append([]SshOption{Password("secret"), InsecureIgnoreHostKey()}, opts...)
+	target, e := NewSshTarget(addr, opts...)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return target
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Accepts connections, but never starts the handshake.
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, e := l.Accept(); e != nil {
+				return
+			}
+		}
+	}()
+
+	target := newTestTarget(t, l.Addr().String(), DialTimeout(100*time.Millisecond))
+	started := time.Now()
+	_, e = target.Command("true")
+	if e == nil {
+		t.Fatalf("expected connecting to time out")
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("expected connecting to be aborted after the timeout, took %s", d)
+	}
+	if !IsTransient(e) {
+		t.Errorf("expected timeout to be transient, got %q", e)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	target := newTestTarget(t, s.listener.Addr().String(), KeepAlive(50*time.Millisecond))
+	defer target.Reset()
+	if _, e := target.Command("true"); e != nil {
+		t.Fatal(e)
+	}
+	client := target.client
+
+	// The server doesn't answer the keepalive requests.
+	for i := 0; client.alive(); i++ {
+		if i > 100 {
+			t.Fatalf("expected unanswered keepalives to close the connection")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, e := target.Command("true"); e != nil {
+		t.Fatalf("expected to reconnect, got %q", e)
+	}
+	if target.client == client || s.connections() != 2 {
+		t.Errorf("expected closed client to be replaced, got %d connections", s.connections())
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	target := newTestTarget(t, s.listener.Addr().String(), KeepAlive(0))
+	defer target.Reset()
+	for i := 1; i <= 3; i++ {
+		if _, e := target.Command("true"); e != nil {
+			t.Fatal(e)
+		}
+		if s.connections() != i {
+			t.Fatalf("expected %d connections, got %d", i, s.connections())
+		}
+		// Drop the connection on the server's side.
+		s.mutex.Lock()
+		s.conns[i-1].Close()
+		s.mutex.Unlock()
+	}
+}
+
+func TestSessionsRefused(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.mutex.Lock()
+	s.maxSessions = 2
+	s.mutex.Unlock()
+
+	target := newTestTarget(t, s.listener.Addr().String(), KeepAlive(0))
+	defer target.Reset()
+	for i := 0; i < 2; i++ {
+		if _, e := target.Command("true"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	client := target.client
+
+	_, e := target.Command("true")
+	if _, ok := e.(*ssh.OpenChannelError); !ok {
+		t.Fatalf("expected the session to be refused, got %v", e)
+	}
+	if !IsTransient(e) {
+		t.Errorf("expected refused session to be transient, got %q", e)
+	}
+	if target.client != client || !client.alive() || s.connections() != 1 {
+		t.Errorf("expected connection to be kept, got %d connections", s.connections())
+	}
+}
@@ -0,0 +1,190 @@
+package target
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Connect through the jump host with the given address (of the form
+// `[<user>@]<host>[:port]`) and options, e.g. to use a key of its own. Jump
+// hosts are connected to in the order given, after those of the target's
+// address.
+//
+// The connections to jump hosts are shared by all targets using the same jump
+// hosts (in the same order, with the same users and options), e.g. in a multi
+// build.
+func JumpHost(addr string, opts ...SshOption) SshOption {
+	return func(t *sshTarget) error {
+		jump, e := NewSshTarget(addr, opts...)
+		if e != nil {
+			return fmt.Errorf("invalid jump host %q: %s", addr, e)
+		}
+		t.jumps = append(t.jumps, jump.jumps...)
+		jump.jumps = nil
+		t.jumps = append(t.jumps, jump)
+		return nil
+	}
+}
+
+// The clients of jump hosts, shared by all targets.
+var jumpClients = &clientPool{clients: map[string]*pooledClient{}}
+
+type clientPool struct {
+	mutex   sync.Mutex
+	clients map[string]*pooledClient
+}
+
+type pooledClient struct {
+	client *sshClient
+	refs   int
+	done   chan struct{} // closed once connecting finished
+	err    error         // why connecting failed
+}
+
+// get returns the client with the given key, connecting using the given
+// function if there is none or its connection is closed. The client must be
+// released when not used anymore. Connecting doesn't block the pool, only
+// those getting the same key wait for it.
+func (p *clientPool) get(key string, connect func() (*sshClient, error)) (*sshClient, error) {
+	p.mutex.Lock()
+	for {
+		pc, ok := p.clients[key]
+		if !ok {
+			break
+		}
+		select {
+		case <-pc.done:
+		default:
+			p.mutex.Unlock()
+			<-pc.done
+			if pc.err != nil {
+				return nil, pc.err
+			}
+			p.mutex.Lock()
+			continue
+		}
+		if pc.client.alive() {
+			pc.refs++
+			p.mutex.Unlock()
+			return pc.client, nil
+		}
+		// The connection broke, references to the client are stale.
+		delete(p.clients, key)
+		break
+	}
+	pc := &pooledClient{done: make(chan struct{})}
+	p.clients[key] = pc
+	p.mutex.Unlock()
+
+	client, e := connect()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc.client, pc.err = client, e
+	if e != nil {
+		delete(p.clients, key)
+	} else {
+		pc.refs = 1
+	}
+	close(pc.done)
+	return client, e
+}
+
+// release gives up a reference to the given client. The client is closed
+// after the last reference is released. Discarded clients are closed already.
+func (p *clientPool) release(key string, client *sshClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc, ok := p.clients[key]
+	if !ok || pc.client != client {
+		return
+	}
+	if pc.refs--; pc.refs <= 0 {
+		pc.client.Close()
+		delete(p.clients, key)
+	}
+}
+
+// discard removes the given client from the pool (e.g. as its connection
+// broke), so that the next get connects again. Existing references stay
+// valid, but shouldn't be used anymore.
+func (p *clientPool) discard(key string, client *sshClient) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pc, ok := p.clients[key]; ok && pc.client == client {
+		pc.client.Close()
+		delete(p.clients, key)
+	}
+}
+
+// A reference to a pooled client of a jump host.
+type jumpRef struct {
+	key    string
+	client *sshClient
+}
+
+// buildJumpClient connects to the target through its jump hosts. If the
+// connection through the last jump host fails due to a transient error (e.g.
+// the pooled client's connection broke), the jump host's client is discarded
+// and connecting is tried once more.
+func (target *sshTarget) buildJumpClient() (client *sshClient, e error) {
+	for attempt := 1; attempt <= 2; attempt++ {
+		var via *sshClient
+		if via, e = target.connectJumps(); e != nil {
+			return nil, e
+		}
+		if client, e = target.connectVia(via); e == nil {
+			return client, nil
+		}
+		last := target.jumpRefs[len(target.jumpRefs)-1]
+		target.releaseJumps()
+		if !IsTransient(e) {
+			break
+		}
+		jumpClients.discard(last.key, last.client)
+	}
+	return nil, e
+}
+
+// connectJumps connects to the target's jump hosts and returns the client of
+// the last one.
+func (target *sshTarget) connectJumps() (*sshClient, error) {
+	var via *sshClient
+	hops := []string{}
+	for _, jump := range target.jumps {
+		hops = append(hops, jump.poolKey())
+		key := strings.Join(hops, ">")
+		prev := via
+		client, e := jumpClients.get(key, func() (*sshClient, error) { return jump.connectVia(prev) })
+		if e != nil {
+			target.releaseJumps()
+			return nil, fmt.Errorf("failed to connect to jump host %s: %s", jump.hostPort(), e)
+		}
+		target.jumpRefs = append(target.jumpRefs, jumpRef{key: key, client: client})
+		via = client
+	}
+	return via, nil
+}
+
+// poolKey identifies the jump host's client in the pool. Besides the address
+// it covers the host key checking and authentication settings, so that a
+// connection set up with laxer ones isn't used by other targets.
+func (target *sshTarget) poolKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%t %t %q %q %q %t %q %q %q\n", target.insecure, target.trustOnFirstUse, target.knownHosts,
+		target.fingerprints, target.sshConfig, target.sshConfigSet, target.identityFiles, target.key, target.Password)
+	for _, c := range target.certificates {
+		fmt.Fprintf(h, "%x\n", c.Marshal())
+	}
+	return fmt.Sprintf("%s@%s/%x", target.user, target.hostPort(), h.Sum(nil)[:8])
+}
+
+// releaseJumps releases the jump hosts' clients used by the target.
+func (target *sshTarget) releaseJumps() {
+	for i := len(target.jumpRefs) - 1; i >= 0; i-- {
+		jumpClients.release(target.jumpRefs[i].key, target.jumpRefs[i].client)
+	}
+	target.jumpRefs = nil
+}
@@ -0,0 +1,187 @@
+package target
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestJumpHosts(t *testing.T) {
+	target, e := NewSshTarget("ops@bastion>inner:2222>app@10.0.0.5", InsecureIgnoreHostKey(), JumpHost("deploy@last", Password("secret")))
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if target.user != "app" || target.address != "10.0.0.5" {
+		t.Errorf("expected target app@10.0.0.5, got %s@%s", target.user, target.address)
+	}
+
+	expected := []string{"ops@bastion:22", "root@inner:2222", "deploy@last:22"}
+	if len(target.jumps) != len(expected) {
+		t.Fatalf("expected %d jump hosts, got %d", len(expected), len(target.jumps))
+	}
+	for i, jump := range target.jumps {
+		if hop := jump.user + "@" + jump.hostPort(); hop != expected[i] {
+			t.Errorf("expected jump host %d to be %q, got %q", i, expected[i], hop)
+		}
+	}
+	if !target.jumps[0].insecure || target.jumps[2].insecure {
+		t.Errorf("expected jump hosts of the address only to share the target's options")
+	}
+	if target.jumps[2].Password != "secret" {
+		t.Errorf("expected jump host to have its own options")
+	}
+
+	target, e = NewSshTarget("bastion>app", HostKeyFingerprints("SHA256:app"), JumpHost("last", HostKeyFingerprints("SHA256:last")))
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if len(target.fingerprints) != 1 || target.jumps[0].fingerprints != nil || target.jumps[1].fingerprints[0] != "SHA256:last" {
+		t.Errorf("expected pinned fingerprints to apply to the target and jump hosts with own options only")
+	}
+
+	if _, e := NewSshTarget("ops@>app@10.0.0.5"); e == nil {
+		t.Errorf("expected an error for an invalid jump host")
+	}
+}
+
+func TestJumpHostPoolKey(t *testing.T) {
+	newJump := func(opts ...SshOption) *sshTarget {
+		target, e := NewSshTarget("app", JumpHost("ops@bastion", opts...))
+		if e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+		return target.jumps[0]
+	}
+
+	key := newJump(Password("secret")).poolKey()
+	if !strings.HasPrefix(key, "ops@bastion:22/") {
+		t.Errorf("expected key to start with the jump host's address, got %q", key)
+	}
+	if other := newJump(Password("secret")).poolKey(); other != key {
+		t.Errorf("expected jump hosts with the same options to share the key, got %q and %q", key, other)
+	}
+	for name, opt := range map[string]SshOption{
+		"insecure":           InsecureIgnoreHostKey(),
+		"trust on first use": TrustOnFirstUse(),
+		"known hosts":        KnownHosts("/tmp/known_hosts"),
+		"fingerprints":       HostKeyFingerprints("SHA256:bastion"),
+		"key":                PrivateKey([]byte("key")),
+	} {
+		if other := newJump(Password("secret"), opt).poolKey(); other == key {
+			t.Errorf("expected %s option to change the key", name)
+		}
+	}
+	if other := newJump(Password("other")).poolKey(); other == key {
+		t.Errorf("expected password to change the key")
+	}
+}
+
+type fakeConn struct {
+	ssh.Conn
+	closed int
+}
+
+func (c *fakeConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClientPool(t *testing.T) {
+	pool := &clientPool{clients: map[string]*pooledClient{}}
+	conns := []*fakeConn{}
+	connect := func() (*sshClient, error) {
+		conn := &fakeConn{}
+		conns = append(conns, conn)
+		return &sshClient{Client: &ssh.Client{Conn: conn}, closed: make(chan struct{})}, nil
+	}
+
+	a, _ := pool.get("bastion", connect)
+	b, _ := pool.get("bastion", connect)
+	if a != b || len(conns) != 1 {
+		t.Fatalf("expected client to be shared, got %d connections", len(conns))
+	}
+	pool.release("bastion", a)
+	if conns[0].closed != 0 {
+		t.Errorf("expected client to stay open while referenced")
+	}
+
+	pool.discard("bastion", a)
+	c, _ := pool.get("bastion", connect)
+	if c == a || len(conns) != 2 || conns[0].closed != 1 {
+		t.Fatalf("expected discarded client to be closed and replaced")
+	}
+	pool.release("bastion", b) // a stale reference must not release the new client
+	if conns[1].closed != 0 {
+		t.Errorf("expected new client to stay open")
+	}
+	pool.release("bastion", c)
+	if conns[1].closed != 1 || len(pool.clients) != 0 {
+		t.Errorf("expected client to be closed after the last release")
+	}
+
+	d, _ := pool.get("bastion", connect)
+	close(d.closed) // the connection broke
+	e, _ := pool.get("bastion", connect)
+	if e == d || len(conns) != 4 {
+		t.Errorf("expected client with closed connection to be replaced")
+	}
+}
+
+func TestClientPoolConcurrentConnects(t *testing.T) {
+	pool := &clientPool{clients: map[string]*pooledClient{}}
+	var mutex sync.Mutex
+	connecting, peak, connects := 0, 0, 0
+	connect := func() (*sshClient, error) {
+		mutex.Lock()
+		connecting++
+		connects++
+		if connecting > peak {
+			peak = connecting
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		connecting--
+		mutex.Unlock()
+		return &sshClient{Client: &ssh.Client{Conn: &fakeConn{}}, closed: make(chan struct{})}, nil
+	}
+
+	// Different jump hosts are connected to concurrently, the same one once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if _, e := pool.get(key, connect); e != nil {
+				t.Errorf("didn't expect an error, got %q", e)
+			}
+		}(fmt.Sprintf("bastion%d", i%2))
+	}
+	wg.Wait()
+	if peak != 2 || connects != 2 {
+		t.Errorf("expected 2 concurrent connects, got %d of %d", peak, connects)
+	}
+
+	// Those waiting for a failing connect get its error.
+	failed := fmt.Errorf("connection refused")
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, e := pool.get("down", func() (*sshClient, error) {
+				time.Sleep(50 * time.Millisecond)
+				return nil, failed
+			}); e != failed {
+				t.Errorf("expected connect error, got %v", e)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := pool.clients["down"]; ok {
+		t.Errorf("expected failed client not to be pooled")
+	}
+}
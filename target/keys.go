@@ -0,0 +1,189 @@
+package target
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Decrypt passphrase protected private keys (given using PrivateKey or
+// configured as identity files) using the given passphrase.
+//
+// Only PEM encoded keys encrypted the legacy way (with a DEK-Info header) can
+// be decrypted. Keys in the OpenSSH format, the default of ssh-keygen since
+// OpenSSH 7.8, and ed25519 keys aren't supported by the vendored ssh package,
+// neither are encrypted PKCS#8 keys. Convert such keys using
+// `ssh-keygen -p -m PEM -f <file>` (not possible for ed25519 keys) or add them
+// to an SSH agent instead.
+func Passphrase(passphrase string) SshOption {
+	return PassphraseCallback(func(string) (string, error) { return passphrase, nil })
+}
+
+// Decrypt passphrase protected private keys using the passphrase returned by
+// the given function (e.g. prompting the user). It is called with the path of
+// the key's file ("" for keys given using PrivateKey) each time a client is
+// built. See Passphrase for the supported key formats.
+func PassphraseCallback(callback func(key string) (string, error)) SshOption {
+	return func(t *sshTarget) error {
+		t.passphrase = callback
+		return nil
+	}
+}
+
+// Authenticate using the given OpenSSH certificate (in the authorized_keys
+// format, like ~/.ssh/id_rsa-cert.pub), paired with the private key or agent
+// key it was issued for. For identity files, certificates are also read from
+// the file with the "-cert.pub" suffix, like ssh does.
+func Certificate(cert []byte) SshOption {
+	return func(t *sshTarget) error {
+		c, e := parseCertificate(cert)
+		if e != nil {
+			return e
+		}
+		t.certificates = append(t.certificates, c)
+		return nil
+	}
+}
+
+func parseCertificate(b []byte) (*ssh.Certificate, error) {
+	key, _, _, _, e := ssh.ParseAuthorizedKey(b)
+	if e != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", e)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("expected a certificate, got a %s key", key.Type())
+	}
+	return cert, nil
+}
+
+// parsePrivateKey parses a PEM encoded private key, decrypting it using the
+// target's passphrase callback if required. The name is the path of the key's
+// file (if any).
+func (target *sshTarget) parsePrivateKey(b []byte, name string) (ssh.Signer, error) {
+	desc := "private key"
+	if name != "" {
+		desc = "identity file " + name
+	}
+	block, _ := pem.Decode(b)
+	switch {
+	case block == nil:
+		return nil, fmt.Errorf("failed to parse %s: no PEM encoded key found", desc)
+	case block.Type == "OPENSSH PRIVATE KEY":
+		return nil, fmt.Errorf("failed to parse %s: the OpenSSH private key format isn't supported, convert the key to PEM using `ssh-keygen -p -m PEM -f <file>`", desc)
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("failed to parse %s: encrypted PKCS#8 keys aren't supported, convert the key to PEM using `ssh-keygen -p -m PEM -f <file>`", desc)
+	case !x509.IsEncryptedPEMBlock(block):
+		signer, e := ssh.ParsePrivateKey(b)
+		if e != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", desc, e)
+		}
+		return signer, nil
+	}
+
+	if target.passphrase == nil {
+		return nil, fmt.Errorf("%s is encrypted, but no passphrase given", desc)
+	}
+	passphrase, e := target.passphrase(name)
+	if e != nil {
+		return nil, fmt.Errorf("failed to get passphrase for %s: %s", desc, e)
+	}
+	der, e := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if e == x509.IncorrectPasswordError {
+		return nil, fmt.Errorf("wrong passphrase for %s", desc)
+	} else if e != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %s", desc, e)
+	}
+	signer, e := ssh.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}))
+	if e != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", desc, e)
+	}
+	return signer, nil
+}
+
+// keySigners returns the signers of the target's private key and identity
+// files, and the certificates found next to the identity files. Like ssh,
+// identity files that can't be used (e.g. of an unsupported format) are
+// skipped with a warning. Their errors are returned, so that they can be
+// reported if no other way to authenticate is left.
+func (target *sshTarget) keySigners() (signers []ssh.Signer, certs []*ssh.Certificate, skipped []error, e error) {
+	if len(target.key) > 0 {
+		signer, e := target.parsePrivateKey(target.key, "")
+		if e != nil {
+			return nil, nil, nil, e
+		}
+		signers = append(signers, signer)
+	}
+	for _, file := range target.identityFiles {
+		signer, cert, e := target.identityFile(file)
+		if e != nil {
+			log.Printf("WARNING: %s (skipped)", e)
+			skipped = append(skipped, e)
+			continue
+		}
+		if signer != nil {
+			signers = append(signers, signer)
+		}
+		if cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+	return signers, certs, skipped, nil
+}
+
+// identityFile returns the signer of the given identity file and the
+// certificate next to it (nil if missing).
+func (target *sshTarget) identityFile(file string) (ssh.Signer, *ssh.Certificate, error) {
+	b, e := ioutil.ReadFile(file)
+	if os.IsNotExist(e) {
+		return nil, nil, nil // like ssh, missing identity files are ignored
+	} else if e != nil {
+		return nil, nil, fmt.Errorf("identity file %s: %s", file, e)
+	}
+	signer, e := target.parsePrivateKey(b, file)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	b, e = ioutil.ReadFile(file + "-cert.pub")
+	if os.IsNotExist(e) {
+		return signer, nil, nil
+	} else if e != nil {
+		return nil, nil, fmt.Errorf("certificate %s: %s", file+"-cert.pub", e)
+	}
+	cert, e := parseCertificate(b)
+	if e != nil {
+		return nil, nil, fmt.Errorf("certificate %s: %s", file+"-cert.pub", e)
+	}
+	return signer, cert, nil
+}
+
+// certSigners pairs the given certificates with the signers of the keys they
+// were issued for. Certificates without matching signer are an error.
+func certSigners(certs []*ssh.Certificate, signers []ssh.Signer) ([]ssh.Signer, error) {
+	certSigners := []ssh.Signer{}
+	for _, cert := range certs {
+		var paired ssh.Signer
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+				paired = signer
+				break
+			}
+		}
+		if paired == nil {
+			return nil, fmt.Errorf("no private key found for certificate %q (key %s)", cert.KeyId, fingerprintSHA256(cert.Key))
+		}
+		s, e := ssh.NewCertSigner(cert, paired)
+		if e != nil {
+			return nil, e
+		}
+		certSigners = append(certSigners, s)
+	}
+	return certSigners, nil
+}
@@ -0,0 +1,302 @@
+package target
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A HostKeyError is returned if the host key presented by a target couldn't be
+// verified.
+type HostKeyError struct {
+	Host        string   // The host as looked up in the known hosts files (e.g. "[example.com]:2222").
+	Fingerprint string   // SHA256 fingerprint of the presented key.
+	Unknown     bool     // No key is known for the host.
+	Revoked     bool     // The presented key is marked as revoked.
+	Known       []string // Locations (file:line) of the known keys, or the pinned fingerprints.
+	Unsupported []string // Locations of known keys that couldn't be parsed (e.g. of unsupported types).
+}
+
+func (e *HostKeyError) Error() string {
+	msg := fmt.Sprintf("host key verification failed for %s: ", e.Host)
+	switch {
+	case e.Revoked:
+		return msg + fmt.Sprintf("key %s is revoked (%s)", e.Fingerprint, strings.Join(e.Known, ", "))
+	case e.Unknown && len(e.Unsupported) > 0:
+		return msg + fmt.Sprintf("only keys of unsupported types are known (%s); add the host's key %s to the known hosts",
+			strings.Join(e.Unsupported, ", "), e.Fingerprint)
+	case e.Unknown:
+		return msg + fmt.Sprintf("host is unknown (key %s); add it to the known hosts or enable trust on first use", e.Fingerprint)
+	default:
+		return msg + fmt.Sprintf("key %s doesn't match the known keys (%s); the host key has changed or someone is intercepting the connection",
+			e.Fingerprint, strings.Join(e.Known, ", "))
+	}
+}
+
+// fingerprintSHA256 returns the fingerprint of the key as printed by
+// ssh-keygen -l (e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8").
+func fingerprintSHA256(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// fingerprintMD5 returns the legacy fingerprint of the key (e.g.
+// "MD5:16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48").
+func fingerprintMD5(key ssh.PublicKey) string {
+	sum := md5.Sum(key.Marshal())
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return "MD5:" + strings.Join(parts, ":")
+}
+
+// matchesFingerprint returns whether the key has the given SHA256 or MD5
+// fingerprint (the "MD5:" prefix being optional).
+func matchesFingerprint(key ssh.PublicKey, fingerprint string) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return strings.TrimRight(fingerprint, "=") == fingerprintSHA256(key)
+	}
+	fingerprint = strings.ToLower(strings.TrimPrefix(fingerprint, "MD5:"))
+	return "MD5:"+fingerprint == fingerprintMD5(key)
+}
+
+// knownHostsAddress returns the host as written to known hosts files, i.e.
+// "host" for the default port and "[host]:port" otherwise.
+func knownHostsAddress(host string, port int) string {
+	if port == 22 {
+		return host
+	}
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
+
+func defaultKnownHostsFile() string {
+	return filepath.Join(homeDir(), ".ssh", "known_hosts")
+}
+
+// A known key of a host, read from a known hosts file.
+type knownKey struct {
+	key      ssh.PublicKey // nil if the key couldn't be parsed
+	revoked  bool
+	location string
+}
+
+// lookupKnownHosts returns the keys of the given host from the given files.
+// Missing files are ignored. Certificate authorities aren't supported, i.e.
+// their lines are skipped. Keys that can't be parsed (like those of types not
+// supported by the ssh package) are returned without key, so that they are
+// ignored like ssh does, but can be reported.
+func lookupKnownHosts(files []string, host string) ([]*knownKey, error) {
+	keys := []*knownKey{}
+	for _, file := range files {
+		f, e := os.Open(file)
+		if os.IsNotExist(e) {
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+		found, e := parseKnownHosts(f, file, host)
+		f.Close()
+		if e != nil {
+			return nil, e
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+func parseKnownHosts(f *os.File, file, host string) ([]*knownKey, error) {
+	keys := []*knownKey{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		revoked := false
+		if strings.HasPrefix(fields[0], "@") {
+			if fields[0] != "@revoked" {
+				continue
+			}
+			revoked = true
+			fields = fields[1:]
+		}
+		if len(fields) < 3 || !matchKnownHost(fields[0], host) {
+			continue
+		}
+		key, _, _, _, e := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		if e != nil {
+			key = nil // e.g. of an unsupported type, see lookupKnownHosts
+		}
+		keys = append(keys, &knownKey{key: key, revoked: revoked, location: fmt.Sprintf("%s:%d", file, line)})
+	}
+	return keys, scanner.Err()
+}
+
+// matchKnownHost returns whether the host matches the given host field of a
+// known hosts line. This is either a hashed host ("|1|salt|hash") or a comma
+// separated list of patterns, with "*" and "?" as wildcards and negations
+// starting with "!".
+func matchKnownHost(field, host string) bool {
+	if strings.HasPrefix(field, "|1|") {
+		parts := strings.Split(field[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, e1 := base64.StdEncoding.DecodeString(parts[0])
+		hash, e2 := base64.StdEncoding.DecodeString(parts[1])
+		if e1 != nil || e2 != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	return matchHostPatterns(strings.Split(field, ","), host)
+}
+
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Keys are recorded by all targets of the process using the same lock, as
+// targets are built concurrently.
+var knownHostsMutex sync.Mutex
+
+// recordKnownHost appends the host's key to the given known hosts file.
+func recordKnownHost(file, host string, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	if e := os.MkdirAll(filepath.Dir(file), 0700); e != nil {
+		return e
+	}
+	f, e := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	_, e = f.Write(append([]byte(host+" "), ssh.MarshalAuthorizedKey(key)...))
+	return e
+}
+
+func (target *sshTarget) knownHostsFiles() []string {
+	if len(target.knownHosts) == 0 {
+		return []string{defaultKnownHostsFile()}
+	}
+	return target.knownHosts
+}
+
+// hostKeyAlgorithms returns the types of the keys known for the target's host,
+// so that the host presents one of those (nil if any key type is accepted).
+func (target *sshTarget) hostKeyAlgorithms() ([]string, error) {
+	if target.insecure || len(target.fingerprints) > 0 {
+		return nil, nil
+	}
+	known, e := lookupKnownHosts(target.knownHostsFiles(), knownHostsAddress(target.address, target.port))
+	if e != nil {
+		return nil, e
+	}
+	var algos []string
+	seen := map[string]bool{}
+	for _, k := range known {
+		if k.key == nil || k.revoked || seen[k.key.Type()] {
+			continue
+		}
+		seen[k.key.Type()] = true
+		algos = append(algos, k.key.Type())
+	}
+	return algos, nil
+}
+
+// verifyHostKey verifies the key presented by the target's host, using the
+// pinned fingerprints if given and the known hosts files otherwise.
+func (target *sshTarget) verifyHostKey(_ string, _ net.Addr, key ssh.PublicKey) error {
+	if target.insecure {
+		return nil
+	}
+	host := knownHostsAddress(target.address, target.port)
+	err := &HostKeyError{Host: host, Fingerprint: fingerprintSHA256(key)}
+
+	if len(target.fingerprints) > 0 {
+		for _, fp := range target.fingerprints {
+			if matchesFingerprint(key, fp) {
+				return nil
+			}
+		}
+		err.Known = target.fingerprints
+		return err
+	}
+
+	files := target.knownHostsFiles()
+	known, e := lookupKnownHosts(files, host)
+	if e != nil {
+		return e
+	}
+	matched := false
+	for _, k := range known {
+		if k.key == nil || !bytes.Equal(k.key.Marshal(), key.Marshal()) {
+			continue
+		}
+		if k.revoked {
+			err.Revoked, err.Known = true, []string{k.location}
+			return err
+		}
+		matched = true
+	}
+	if matched {
+		return nil
+	}
+
+	for _, k := range known {
+		switch {
+		case k.key == nil:
+			err.Unsupported = append(err.Unsupported, k.location)
+		case !k.revoked:
+			err.Known = append(err.Known, k.location)
+		}
+	}
+	if len(err.Known) > 0 {
+		return err
+	}
+	// Keys of other types are known, so the presented one can't be trusted.
+	if target.trustOnFirstUse && len(err.Unsupported) == 0 {
+		return recordKnownHost(files[0], host, key)
+	}
+	err.Unknown = true
+	return err
+}
@@ -0,0 +1,162 @@
+package target
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	priv, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	key, e := ssh.NewPublicKey(&priv.PublicKey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return key
+}
+
+func hashKnownHost(host string) string {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func knownHostsLine(hosts string, key ssh.PublicKey) string {
+	return hosts + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestMatchKnownHost(t *testing.T) {
+	for _, tc := range []struct {
+		field, host string
+		matches     bool
+	}{
+		{"example.com", "example.com", true},
+		{"other.com,example.com", "example.com", true},
+		{"example.com", "[example.com]:2222", false},
+		{"[example.com]:2222", "[example.com]:2222", true},
+		{"*.example.com", "web.example.com", true},
+		{"web?.example.com", "web1.example.com", true},
+		{"*.example.com,!db.example.com", "db.example.com", false},
+		{hashKnownHost("example.com"), "example.com", true},
+		{hashKnownHost("example.com"), "other.com", false},
+	} {
+		if m := matchKnownHost(tc.field, tc.host); m != tc.matches {
+			t.Errorf("expected match of %q with %q to be %t", tc.field, tc.host, tc.matches)
+		}
+	}
+}
+
+func TestVerifyHostKey(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall-known-hosts")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	key, other, revoked := newTestHostKey(t), newTestHostKey(t), newTestHostKey(t)
+	file := filepath.Join(dir, "known_hosts")
+	// Keys of types the ssh package doesn't support are skipped.
+	ed25519 := " ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+	content := "# comment\n" +
+		"known.com" + ed25519 +
+		knownHostsLine(hashKnownHost("known.com"), key) +
+		"edonly.com" + ed25519 +
+		knownHostsLine("[changed.com]:2222", other) +
+		"@revoked " + knownHostsLine("*", revoked)
+	if e := ioutil.WriteFile(file, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	verify := func(addr string, k ssh.PublicKey, opts ...SshOption) error {
+		target, e := NewSshTarget(addr, append([]SshOption{KnownHosts(file)}, opts...)...)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return target.verifyHostKey(addr, nil, k)
+	}
+
+	if e := verify("known.com", key); e != nil {
+		t.Errorf("expected known key to be accepted, got %q", e)
+	}
+	if e, ok := verify("changed.com:2222", key).(*HostKeyError); !ok || e.Unknown || !strings.Contains(e.Error(), file+":5") {
+		t.Errorf("expected mismatch error, got %v", e)
+	}
+	if e, ok := verify("known.com", revoked).(*HostKeyError); !ok || !e.Revoked {
+		t.Errorf("expected revoked error, got %v", e)
+	}
+	if e, ok := verify("new.com", key).(*HostKeyError); !ok || !e.Unknown {
+		t.Errorf("expected unknown host error, got %v", e)
+	}
+	if e := verify("new.com", key, InsecureIgnoreHostKey()); e != nil {
+		t.Errorf("expected any key to be accepted, got %q", e)
+	}
+
+	if e, ok := verify("edonly.com", key, TrustOnFirstUse()).(*HostKeyError); !ok || !e.Unknown || len(e.Unsupported) != 1 {
+		t.Errorf("expected unknown host error listing the unsupported key, got %v", e)
+	}
+
+	if e := verify("new.com", key, TrustOnFirstUse()); e != nil {
+		t.Errorf("expected new key to be recorded, got %q", e)
+	}
+	if e := verify("new.com", key); e != nil {
+		t.Errorf("expected recorded key to be accepted, got %q", e)
+	}
+	if e := verify("new.com", other, TrustOnFirstUse()); e == nil {
+		t.Errorf("expected changed key to be rejected despite trust on first use")
+	}
+
+	if e := verify("new.com", other, HostKeyFingerprints(fingerprintSHA256(key), fingerprintSHA256(other))); e != nil {
+		t.Errorf("expected pinned key to be accepted, got %q", e)
+	}
+	if e := verify("known.com", key, HostKeyFingerprints(strings.ToUpper(fingerprintMD5(other)[4:]))); e == nil {
+		t.Errorf("expected key not matching the pinned fingerprint to be rejected")
+	}
+	if e := verify("known.com", key, HostKeyFingerprints(fingerprintMD5(key)[4:])); e != nil {
+		t.Errorf("expected key matching the pinned MD5 fingerprint to be accepted, got %q", e)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall-known-hosts")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+	content := "known.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n" +
+		knownHostsLine("known.com", newTestHostKey(t)) +
+		knownHostsLine("known.com", newTestHostKey(t))
+	if e := ioutil.WriteFile(file, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+
+	for host, expected := range map[string][]string{"known.com": {"ecdsa-sha2-nistp256"}, "new.com": nil} {
+		target, e := NewSshTarget(host, KnownHosts(file))
+		if e != nil {
+			t.Fatal(e)
+		}
+		algos, e := target.hostKeyAlgorithms()
+		if e != nil {
+			t.Fatalf("didn't expect an error, got %q", e)
+		}
+		if !reflect.DeepEqual(algos, expected) {
+			t.Errorf("expected host key algorithms %v for %s, got %v", expected, host, algos)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Create a target for local provisioning.
@@ -52,9 +54,13 @@ func whoami() (string, error) {
 }
 
 func (c *localTarget) Command(cmd string) (ExecCommand, error) {
-	return &localCommand{
-		command: exec.Command("bash", "-c", cmd),
-	}, nil
+	command := exec.Command("bash", "-c", cmd)
+	// The command gets a process group of its own, so that interrupting it
+	// signals the processes it started as well. Processes running as another
+	// user (e.g. started by sudo) can't be killed this way, but sudo passes
+	// the TERM signal on.
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &localCommand{command: command}, nil
 }
 
 func (c *localTarget) Reset() (e error) {
@@ -63,6 +69,7 @@ func (c *localTarget) Reset() (e error) {
 
 type localCommand struct {
 	command *exec.Cmd
+	exited  chan struct{} // closed once Wait returned
 }
 
 func (c *localCommand) StdoutPipe() (io.Reader, error) {
@@ -90,13 +97,36 @@ func (c *localCommand) SetStdin(r io.Reader) {
 }
 
 func (c *localCommand) Wait() error {
+	defer close(c.exited)
 	return c.command.Wait()
 }
 
 func (c *localCommand) Start() error {
+	c.exited = make(chan struct{})
 	return c.command.Start()
 }
 
+// Send the TERM signal to the command's process group, and the KILL signal if
+// the command didn't terminate after the grace period.
+func (c *localCommand) Interrupt() error {
+	if c.command.Process == nil {
+		return nil
+	}
+	pgid, exited := c.command.Process.Pid, c.exited
+	time.AfterFunc(interruptGracePeriod, func() {
+		select {
+		case <-exited:
+			// The process group might be gone or reused.
+		default:
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	})
+	return syscall.Kill(-pgid, syscall.SIGTERM)
+}
+
 func (c *localCommand) Run() error {
-	return c.command.Run()
+	if e := c.Start(); e != nil {
+		return e
+	}
+	return c.Wait()
 }
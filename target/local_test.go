@@ -0,0 +1,61 @@
+package target
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// running returns whether the process with the given pid is running, i.e.
+// exists and is no zombie.
+func running(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, e := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if e != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestLocalCommandInterrupt(t *testing.T) {
+	cmd, e := NewLocalTarget().Command("sleep 30 & echo $!; wait")
+	if e != nil {
+		t.Fatal(e)
+	}
+	stdout, e := cmd.StdoutPipe()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = cmd.Start(); e != nil {
+		t.Fatal(e)
+	}
+	line, e := bufio.NewReader(stdout).ReadString('\n')
+	if e != nil {
+		t.Fatal(e)
+	}
+	pid, e := strconv.Atoi(strings.TrimSpace(line))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = cmd.(Interrupter).Interrupt(); e != nil {
+		t.Fatal(e)
+	}
+	if e = cmd.Wait(); e == nil {
+		t.Errorf("expected interrupted command to fail")
+	}
+	for i := 0; running(pid); i++ {
+		if i > 100 {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("expected child process %d to be killed", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
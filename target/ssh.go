@@ -7,13 +7,17 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-func NewSshTargetWithPrivateKey(addr string, key []byte) (target *sshTarget, err error) {
-	t, err := NewSshTarget(addr)
+// Create a target for provisioning via SSH, authenticating with the given PEM
+// encoded private key (see PrivateKey).
+func NewSshTargetWithPrivateKey(addr string, key []byte, opts ...SshOption) (target *sshTarget, err error) {
+	t, err := NewSshTarget(addr, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -21,17 +25,86 @@ func NewSshTargetWithPrivateKey(addr string, key []byte) (target *sshTarget, err
 	return t, nil
 }
 
-// Create a target for provisioning via SSH.
-func NewSshTarget(addr string) (target *sshTarget, e error) {
-	target = &sshTarget{port: 22, user: "root"}
+// Create a target for provisioning via SSH. The host's key is verified using
+// ~/.ssh/known_hosts, unless configured otherwise by the given options.
+//
+// Hosts only reachable through jump hosts are given by prefixing the address
+// with those, separated by ">" (e.g. "ops@bastion>app@10.0.0.5:2222"). The
+// jump hosts use the same options as the target, except for pinned host key
+// fingerprints (their keys are verified using the known hosts). See JumpHost
+// for jump hosts with options of their own.
+//
+// The SSH config (~/.ssh/config and /etc/ssh/ssh_config, see SshConfig) is
+// honoured like ssh does, i.e. the host can be an alias and HostName, User,
+// Port, IdentityFile and ProxyJump are taken from the config. User and port
+// given in the address take precedence, as do jump hosts.
+//
+// Connecting times out after 30 seconds and keepalive requests are sent every
+// 30 seconds (see DialTimeout and KeepAlive). Broken connections are replaced
+// transparently when the next command is created.
+func NewSshTarget(addr string, opts ...SshOption) (target *sshTarget, e error) {
+	return newSshTarget(addr, opts, 0)
+}
+
+// The maximum number of nested jump hosts, guarding against loops in the SSH
+// config's ProxyJump settings.
+const maxJumpDepth = 8
+
+// newSshTarget creates the target with the given address and options. The
+// target is a jump host of another one if depth is greater than 0. Jump hosts
+// of jump hosts are flattened into the target's list of jump hosts, and jump
+// hosts given using JumpHost options are only used for the outermost target.
+func newSshTarget(addr string, opts []SshOption, depth int) (target *sshTarget, e error) {
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("more than %d nested jump hosts (loop in ProxyJump?)", maxJumpDepth)
+	}
+	target = &sshTarget{port: 22, user: "root", dialTimeout: defaultDialTimeout, keepAlive: defaultKeepAlive}
+
+	hops := strings.Split(addr, ">")
+	userGiven, portGiven, e := target.parseAddress(hops[len(hops)-1])
+	if e != nil {
+		return nil, e
+	}
+	for _, opt := range opts {
+		if e := opt(target); e != nil {
+			return nil, e
+		}
+	}
+	proxyJump, e := target.applySshConfig(userGiven, portGiven)
+	if e != nil {
+		return nil, e
+	}
+
+	if len(hops) > 1 {
+		proxyJump = hops[:len(hops)-1]
+	}
+	jumps := []*sshTarget{}
+	for _, hop := range proxyJump {
+		jump, e := newSshTarget(hop, opts, depth+1)
+		if e != nil {
+			return nil, fmt.Errorf("invalid jump host %q: %s", hop, e)
+		}
+		jump.fingerprints = nil // pinned for the target only
+		jumps = append(append(jumps, jump.jumps...), jump)
+	}
+	if depth == 0 {
+		jumps = append(jumps, target.jumps...)
+	}
+	target.jumps = jumps
+	return target, nil
+}
 
+// parseAddress sets user, host and port of the target from an address of the
+// form `[<user>@]<host>[:port]`, and returns whether user and port were given.
+func (target *sshTarget) parseAddress(addr string) (userGiven, portGiven bool, e error) {
 	hostAndPort := strings.SplitN(addr, ":", 2)
 	if len(hostAndPort) == 2 {
 		addr = hostAndPort[0]
 		target.port, e = strconv.Atoi(hostAndPort[1])
 		if e != nil {
-			return nil, fmt.Errorf("port must be given as integer, got %q", hostAndPort[1])
+			return false, false, fmt.Errorf("port must be given as integer, got %q", hostAndPort[1])
 		}
+		portGiven = true
 	}
 
 	userAndAddress := strings.Split(addr, "@")
@@ -41,15 +114,76 @@ func NewSshTarget(addr string) (target *sshTarget, e error) {
 	case 2:
 		target.user = userAndAddress[0]
 		target.address = userAndAddress[1]
+		userGiven = true
 	default:
-		return nil, fmt.Errorf("expected target address of the form '<user>@<host>', but was given: %s", addr)
+		return false, false, fmt.Errorf("expected target address of the form '<user>@<host>', but was given: %s", addr)
 	}
 
 	if target.address == "" {
-		e = fmt.Errorf("empty address given for target")
+		return false, false, fmt.Errorf("empty address given for target")
 	}
+	return userGiven, portGiven, nil
+}
+
+// An option of SSH targets.
+type SshOption func(*sshTarget) error
+
+// Verify host keys using the given known hosts files (in the format of
+// OpenSSH, hashed hosts included) instead of ~/.ssh/known_hosts. New keys are
+// recorded in the first file when trusting on first use.
+func KnownHosts(files ...string) SshOption {
+	return func(t *sshTarget) error {
+		t.knownHosts = append(t.knownHosts, files...)
+		return nil
+	}
+}
+
+// Accept only host keys with one of the given fingerprints (as printed by
+// ssh-keygen -l, e.g. "SHA256:nThbg6kX..." or "MD5:16:27:ac:..."). Known hosts
+// files are not used then. The fingerprints only apply to the target, not to
+// the jump hosts of its address or SSH config (see JumpHost).
+func HostKeyFingerprints(fingerprints ...string) SshOption {
+	return func(t *sshTarget) error {
+		t.fingerprints = append(t.fingerprints, fingerprints...)
+		return nil
+	}
+}
+
+// Record the key of hosts not known yet in the known hosts file, instead of
+// failing. Keys that don't match the known ones are still rejected, as are
+// keys of hosts with only keys of unsupported types (like ssh-ed25519) known.
+func TrustOnFirstUse() SshOption {
+	return func(t *sshTarget) error {
+		t.trustOnFirstUse = true
+		return nil
+	}
+}
+
+// Accept any host key. This makes the connection vulnerable to
+// man-in-the-middle attacks and should only be used for testing.
+func InsecureIgnoreHostKey() SshOption {
+	return func(t *sshTarget) error {
+		t.insecure = true
+		return nil
+	}
+}
+
+// Authenticate using the given private key (in addition to the keys of a
+// running SSH agent). The key must be PEM encoded (RSA, ECDSA or DSA), keys in
+// the OpenSSH format and ed25519 keys aren't supported (see Passphrase).
+func PrivateKey(key []byte) SshOption {
+	return func(t *sshTarget) error {
+		t.key = key
+		return nil
+	}
+}
 
-	return target, e
+// Authenticate using the given password.
+func Password(password string) SshOption {
+	return func(t *sshTarget) error {
+		t.Password = password
+		return nil
+	}
 }
 
 type sshTarget struct {
@@ -59,9 +193,26 @@ type sshTarget struct {
 	port    int
 	address string
 
-	key []byte
+	key          []byte
+	passphrase   func(key string) (string, error) // returns the passphrase of encrypted keys
+	certificates []*ssh.Certificate
+
+	identityFiles   []string // private keys configured in the SSH config
+	sshConfig       []string // SSH config files (only used if sshConfigSet)
+	sshConfigSet    bool
+	knownHosts      []string // known hosts files (~/.ssh/known_hosts if empty)
+	fingerprints    []string // pinned host key fingerprints
+	trustOnFirstUse bool
+	insecure        bool
+
+	jumps    []*sshTarget // jump hosts, in the order they are connected to
+	jumpRefs []jumpRef    // the jump hosts' pooled clients used by the client
 
-	client *ssh.Client
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+
+	mutex  sync.Mutex // Guards the client, as commands may be created concurrently.
+	client *sshClient
 }
 
 func (target *sshTarget) User() string {
@@ -73,6 +224,44 @@ func (target *sshTarget) String() string {
 }
 
 func (target *sshTarget) Command(cmd string) (ExecCommand, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	cached := target.client != nil && target.client.alive()
+	ses, e := target.newSession()
+	if cached && e != nil && target.connectionBroken(e) {
+		// The cached connection broke without being noticed yet (e.g. as
+		// keepalives are disabled), so reconnect once.
+		target.closeClient()
+		ses, e = target.newSession()
+	}
+	if e != nil {
+		return nil, e
+	}
+	return &sshCommand{command: cmd, session: ses}, nil
+}
+
+// connectionBroken returns whether the client's connection is dead, given that
+// creating a session failed with the given error. Servers refusing sessions
+// (e.g. as sshd's MaxSessions is reached) are alive, and closing the
+// connection would abort all commands running on it.
+func (target *sshTarget) connectionBroken(e error) bool {
+	if _, ok := e.(*ssh.OpenChannelError); ok {
+		return false
+	}
+	timeout := target.dialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	return !target.client.probe(timeout)
+}
+
+// newSession creates a session, (re)connecting if there is no client or its
+// connection is closed.
+func (target *sshTarget) newSession() (*ssh.Session, error) {
+	if target.client != nil && !target.client.alive() {
+		target.closeClient()
+	}
 	if target.client == nil {
 		var e error
 		target.client, e = target.buildClient()
@@ -80,25 +269,56 @@ func (target *sshTarget) Command(cmd string) (ExecCommand, error) {
 			return nil, e
 		}
 	}
-	ses, e := target.client.NewSession()
-	if e != nil {
-		return nil, e
-	}
-	return &sshCommand{command: cmd, session: ses}, nil
+	return target.client.NewSession()
 }
 
 func (target *sshTarget) Reset() (e error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	return target.closeClient()
+}
+
+// closeClient closes the client and releases the jump hosts' clients.
+func (target *sshTarget) closeClient() (e error) {
 	if target.client != nil {
 		e = target.client.Close()
 		target.client = nil
 	}
+	target.releaseJumps()
 	return e
 }
 
-func (target *sshTarget) buildClient() (*ssh.Client, error) {
-	var e error
-	config := &ssh.ClientConfig{
-		User: target.user,
+func (target *sshTarget) buildClient() (*sshClient, error) {
+	if len(target.jumps) > 0 {
+		return target.buildJumpClient()
+	}
+	return target.connectVia(nil)
+}
+
+func (target *sshTarget) hostPort() string {
+	return fmt.Sprintf("%s:%d", target.address, target.port)
+}
+
+// clientConfig returns the configuration to connect to the target. The
+// returned function closes the connection to the SSH agent (if used), which is
+// only needed until the handshake is done.
+func (target *sshTarget) clientConfig() (config *ssh.ClientConfig, closeAgent func(), e error) {
+	closeAgent = func() {}
+	defer func() {
+		if e != nil {
+			closeAgent()
+		}
+	}()
+
+	algos, e := target.hostKeyAlgorithms()
+	if e != nil {
+		return nil, closeAgent, e
+	}
+	config = &ssh.ClientConfig{
+		User:              target.user,
+		HostKeyCallback:   target.verifyHostKey,
+		HostKeyAlgorithms: algos,
 	}
 
 	signers := []ssh.Signer{}
@@ -106,30 +326,40 @@ func (target *sshTarget) buildClient() (*ssh.Client, error) {
 		config.Auth = append(config.Auth, ssh.Password(target.Password))
 	} else if sshSocket := os.Getenv("SSH_AUTH_SOCK"); sshSocket != "" {
 		if agentConn, e := net.Dial("unix", sshSocket); e == nil {
+			closeAgent = func() { agentConn.Close() }
 			s, err := agent.NewClient(agentConn).Signers()
 			if err != nil {
-				return nil, err
+				return nil, closeAgent, err
 			}
 			signers = append(signers, s...)
 		}
 	}
-	if len(target.key) > 0 {
-		key, err := ssh.ParsePrivateKey(target.key)
+	keys, certs, skipped, err := target.keySigners()
+	if err != nil {
+		return nil, closeAgent, err
+	}
+	signers = append(signers, keys...)
+	// Certificates are offered first, like ssh does.
+	certs = append(append([]*ssh.Certificate{}, target.certificates...), certs...)
+	if len(certs) > 0 {
+		s, err := certSigners(certs, signers)
 		if err != nil {
-			return nil, err
+			return nil, closeAgent, err
 		}
-		signers = append(signers, key)
+		signers = append(s, signers...)
 	}
 
 	if len(signers) > 0 {
 		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
 	}
-
-	con, e := ssh.Dial("tcp", fmt.Sprintf("%s:%d", target.address, target.port), config)
-	if e != nil {
-		return nil, e
+	if len(config.Auth) == 0 && len(skipped) > 0 {
+		msgs := []string{}
+		for _, e := range skipped {
+			msgs = append(msgs, e.Error())
+		}
+		return nil, closeAgent, fmt.Errorf("no usable authentication method: %s", strings.Join(msgs, "; "))
 	}
-	return &ssh.Client{Conn: con}, nil
+	return config, closeAgent, nil
 }
 
 type sshCommand struct {
@@ -165,6 +395,21 @@ func (c *sshCommand) SetStdin(r io.Reader) {
 	c.session.Stdin = r
 }
 
+// Send the TERM signal to the remote process, and the KILL signal and close
+// the session if it didn't terminate after the grace period. Not all SSH
+// servers support signals, and closing a session without a pty leaves the
+// processes running, only terminating the connected process' stdio.
+func (c *sshCommand) Interrupt() error {
+	if e := c.session.Signal(ssh.SIGTERM); e != nil {
+		return c.session.Close()
+	}
+	time.AfterFunc(interruptGracePeriod, func() {
+		_ = c.session.Signal(ssh.SIGKILL)
+		c.session.Close()
+	})
+	return nil
+}
+
 func (c *sshCommand) Run() error {
 	return c.session.Run(c.command)
 }
@@ -0,0 +1,231 @@
+package target
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Use the given SSH config files (in the format of OpenSSH) instead of
+// ~/.ssh/config and /etc/ssh/ssh_config. Without files no config is used.
+func SshConfig(files ...string) SshOption {
+	return func(t *sshTarget) error {
+		t.sshConfig = files
+		t.sshConfigSet = true
+		return nil
+	}
+}
+
+// The settings of a host read from SSH config files. Like with ssh, the first
+// value found for a setting is used (identity files are collected).
+type sshHostConfig struct {
+	hostName      string
+	user          string
+	port          string
+	identityFiles []string
+	proxyJump     string
+}
+
+// The maximum nesting of Include directives.
+const maxIncludeDepth = 16
+
+// applySshConfig sets the target's address, user, port and identity files
+// from the SSH config and returns the jump hosts configured using ProxyJump.
+// User and port given in the target's address take precedence.
+func (target *sshTarget) applySshConfig(userGiven, portGiven bool) ([]string, error) {
+	files := target.sshConfig
+	if !target.sshConfigSet {
+		files = []string{filepath.Join(homeDir(), ".ssh", "config"), "/etc/ssh/ssh_config"}
+	}
+	alias := target.address
+	cfg := &sshHostConfig{}
+	for _, file := range files {
+		if e := cfg.read(file, filepath.Dir(file), alias, 0); e != nil {
+			return nil, e
+		}
+	}
+
+	if cfg.hostName != "" {
+		target.address = expandSshTokens(cfg.hostName, alias, target.user)
+	}
+	if cfg.user != "" && !userGiven {
+		target.user = cfg.user
+	}
+	if cfg.port != "" && !portGiven {
+		port, e := strconv.Atoi(cfg.port)
+		if e != nil {
+			return nil, fmt.Errorf("invalid port %q in SSH config for host %q", cfg.port, alias)
+		}
+		target.port = port
+	}
+	for _, f := range cfg.identityFiles {
+		target.identityFiles = append(target.identityFiles, expandSshTokens(f, alias, target.user))
+	}
+	if cfg.proxyJump == "" || strings.ToLower(cfg.proxyJump) == "none" {
+		return nil, nil
+	}
+	return strings.Split(cfg.proxyJump, ","), nil
+}
+
+// read reads the settings of the given host from the config file. Missing
+// files are ignored. Relative paths of included files are resolved using the
+// given directory (the one of the file not included).
+func (cfg *sshHostConfig) read(file, dir, host string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("SSH config includes nested too deeply (at %s)", file)
+	}
+	f, e := os.Open(file)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	active := true // settings before the first Host or Match line apply to all hosts
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args := parseSshConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			active = matchHostPatterns(args, host)
+		case "match":
+			// Only "Match all" is supported, other criteria never match.
+			active = len(args) == 1 && strings.ToLower(args[0]) == "all"
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				matches, e := filepath.Glob(pattern)
+				if e != nil {
+					return fmt.Errorf("invalid include %q in %s:%d: %s", pattern, file, line, e)
+				}
+				for _, m := range matches {
+					if e := cfg.read(m, dir, host, depth+1); e != nil {
+						return e
+					}
+				}
+			}
+		default:
+			if active && len(args) > 0 {
+				cfg.set(keyword, args)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (cfg *sshHostConfig) set(keyword string, args []string) {
+	first := func(value *string) {
+		if *value == "" {
+			*value = args[0]
+		}
+	}
+	switch keyword {
+	case "hostname":
+		first(&cfg.hostName)
+	case "user":
+		first(&cfg.user)
+	case "port":
+		first(&cfg.port)
+	case "proxyjump":
+		first(&cfg.proxyJump)
+	case "identityfile":
+		cfg.identityFiles = append(cfg.identityFiles, args[0])
+	}
+}
+
+// parseSshConfigLine returns the lower cased keyword and the arguments of the
+// given line. Keyword and arguments are separated by whitespace or "=", and
+// arguments can be double quoted.
+func parseSshConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i == -1 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	args := []string{}
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			if end := strings.Index(rest[1:], `"`); end != -1 {
+				arg, rest = rest[1:end+1], rest[end+2:]
+			} else {
+				arg, rest = rest[1:], ""
+			}
+		} else if end := strings.IndexAny(rest, " \t"); end != -1 {
+			arg, rest = rest[:end], rest[end:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args
+}
+
+// matchHostPatterns returns whether the host matches any of the patterns and
+// none of the negated ones.
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchWildcard(strings.TrimPrefix(pattern, "!"), host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// expandSshTokens expands "~" and the tokens %h (host as given), %r (remote
+// user), %u (local user), %d (local home directory) and %%.
+func expandSshTokens(s, host, remoteUser string) string {
+	localUser := ""
+	if u, e := user.Current(); e == nil {
+		localUser = u.Username
+	}
+	r := strings.NewReplacer("%%", "%", "%h", host, "%r", remoteUser, "%u", localUser, "%d", homeDir())
+	return r.Replace(expandHome(s))
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return homeDir() + path[1:]
+	}
+	return path
+}
+
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	if u, e := user.Current(); e == nil {
+		return u.HomeDir
+	}
+	return ""
+}
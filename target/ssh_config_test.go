@@ -0,0 +1,133 @@
+package target
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testSshConfig = `# defaults
+IdentityFile ~/.ssh/default
+Include conf.d/*
+
+Host db-primary
+    HostName 10.0.0.5
+    User postgres
+    ProxyJump bastion
+
+Host bastion
+    HostName bastion.example.com
+    User ops
+    Port 2222
+    ProxyJump none
+
+Host *.internal !legacy.internal
+    HostName %h.example.com
+    User = "deploy"
+    Port=2200
+
+Host *
+    User fallback
+    Port 2201
+`
+
+const testSshConfigInclude = `Host web-?
+    HostName web.example.com
+    IdentityFile /keys/web
+`
+
+func TestSshConfig(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall-ssh-config")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	if e := os.Mkdir(filepath.Join(dir, "conf.d"), 0700); e != nil {
+		t.Fatal(e)
+	}
+	config := filepath.Join(dir, "config")
+	if e := ioutil.WriteFile(config, []byte(testSshConfig), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(filepath.Join(dir, "conf.d", "web"), []byte(testSshConfigInclude), 0600); e != nil {
+		t.Fatal(e)
+	}
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/test")
+
+	for addr, expected := range map[string]struct {
+		user, address string
+		port          int
+		jumps         []string
+		identities    []string
+	}{
+		"db-primary":          {"postgres", "10.0.0.5", 2201, []string{"ops@bastion.example.com:2222"}, []string{"/home/test/.ssh/default"}},
+		"admin@db-primary:22": {"admin", "10.0.0.5", 22, []string{"ops@bastion.example.com:2222"}, []string{"/home/test/.ssh/default"}},
+		"other>db-primary":    {"postgres", "10.0.0.5", 2201, []string{"fallback@other:2201"}, []string{"/home/test/.ssh/default"}},
+		"web-1":               {"fallback", "web.example.com", 2201, nil, []string{"/home/test/.ssh/default", "/keys/web"}},
+		"app.internal":        {"deploy", "app.internal.example.com", 2200, nil, []string{"/home/test/.ssh/default"}},
+		"legacy.internal":     {"fallback", "legacy.internal", 2201, nil, []string{"/home/test/.ssh/default"}},
+	} {
+		target, e := NewSshTarget(addr, SshConfig(config))
+		if e != nil {
+			t.Errorf("didn't expect an error for %q, got %q", addr, e)
+			continue
+		}
+		if target.user != expected.user || target.address != expected.address || target.port != expected.port {
+			t.Errorf("expected %q to resolve to %s@%s:%d, got %s@%s:%d", addr,
+				expected.user, expected.address, expected.port, target.user, target.address, target.port)
+		}
+		jumps := []string(nil)
+		for _, jump := range target.jumps {
+			jumps = append(jumps, jump.user+"@"+jump.hostPort())
+		}
+		if !reflect.DeepEqual(jumps, expected.jumps) {
+			t.Errorf("expected jump hosts %v for %q, got %v", expected.jumps, addr, jumps)
+		}
+		if !reflect.DeepEqual(target.identityFiles, expected.identities) {
+			t.Errorf("expected identity files %v for %q, got %v", expected.identities, addr, target.identityFiles)
+		}
+	}
+
+	target, e := NewSshTarget("db-primary", SshConfig())
+	if e != nil {
+		t.Fatalf("didn't expect an error, got %q", e)
+	}
+	if target.address != "db-primary" || target.user != "root" || len(target.jumps) != 0 {
+		t.Errorf("expected config not to be used, got %s@%s", target.user, target.address)
+	}
+}
+
+func TestSshConfigProxyJumpLoop(t *testing.T) {
+	dir, e := ioutil.TempDir("", "urknall-ssh-config")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	if e := ioutil.WriteFile(config, []byte("Host a\n  ProxyJump b\nHost b\n  ProxyJump a\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := NewSshTarget("a", SshConfig(config)); e == nil {
+		t.Errorf("expected an error for a ProxyJump loop")
+	}
+}
+
+func TestParseSshConfigLine(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"Host a b":                  {"host", "a", "b"},
+		"  user=deploy":             {"user", "deploy"},
+		"Port = 22":                 {"port", "22"},
+		`IdentityFile "/my keys/x"`: {"identityfile", "/my keys/x"},
+	} {
+		keyword, args := parseSshConfigLine(line)
+		if got := append([]string{keyword}, args...); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %q to be parsed to %q, got %q", line, expected, got)
+		}
+	}
+	if keyword, _ := parseSshConfigLine("# comment"); keyword != "" {
+		t.Errorf("expected comments to be ignored")
+	}
+}
@@ -14,6 +14,10 @@ import (
 // command has been executed already, none of the preceding tasks has changed
 // and neither the command itself, then it won't be executed again. This
 // enhances performance and removes the burden of writing idempotent commands.
+//
+// Tasks created using NewTask can depend on other tasks (or templates), see
+// DependsOn, and notify handlers, see NotifyHandlers. Environment variables set
+// for a task (by adding an Env value) apply to all its commands.
 type Task interface {
 	Add(cmds ...interface{}) Task
 	Commands() ([]cmd.Command, error)
@@ -36,6 +40,18 @@ type task struct {
 	validated bool
 
 	started time.Time // time used to for caching timestamp
+
+	cachedChecksums []string // checksums of the commands executed in the task's last run
+
+	dependencies []dependency // dependencies as declared
+	deps         []*task      // resolved dependencies
+	implicitDeps []*task      // dependencies due to the position of handlers
+
+	scope    string   // name of the package the task was added to
+	notifies []string // handlers notified by all commands of the task
+	env      []string // environment variables set for all commands of the task
+	handler  bool     // whether the task is a handler
+	flush    bool     // marks the position handlers are flushed at
 }
 
 func (t *task) Commands() (cmds []cmd.Command, e error) {
@@ -53,6 +69,8 @@ func (t *task) Commands() (cmds []cmd.Command, e error) {
 func (task *task) Add(cmds ...interface{}) Task {
 	for _, c := range cmds {
 		switch t := c.(type) {
+		case Env:
+			task.env = append(task.env, t...)
 		case string:
 			// No explicit expansion required as the function is called recursively with a ShellCommand type, that has
 			// explicitly renders the template.
@@ -66,6 +84,34 @@ func (task *task) Add(cmds ...interface{}) Task {
 	return task
 }
 
+// DependsOn makes the given task depend on the tasks (or templates) with the
+// given names, relative to the package the task is added to (see Dependent).
+// The task must have been created using NewTask.
+func DependsOn(t Task, names ...string) Task {
+	task := mustTask(t)
+	for _, name := range names {
+		task.dependencies = append(task.dependencies, dependency{name: name})
+	}
+	return task
+}
+
+// NotifyHandlers makes the given task notify the handlers with the given names
+// (see AddHandler), if any of its commands is executed. The task must have
+// been created using NewTask.
+func NotifyHandlers(t Task, handlers ...string) Task {
+	task := mustTask(t)
+	task.notifies = append(task.notifies, handlers...)
+	return task
+}
+
+func mustTask(t Task) *task {
+	task, ok := t.(*task)
+	if !ok {
+		panic(fmt.Sprintf("task of type %T not supported (use NewTask)", t))
+	}
+	return task
+}
+
 func (task *task) validate() error {
 	if !task.validated {
 		if task.taskBuilder == nil {
@@ -2,30 +2,104 @@ package urknall
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/megamsys/urknall/cmd"
 )
 
-func renderTemplate(builder Template) (*packageImpl, error) {
-	p := &packageImpl{reference: builder}
-	e := validateTemplate(builder)
+// Rendering validates (and thereby modifies) the template, so concurrent builds
+// of the same template must not render at the same time.
+var renderMutex = &sync.Mutex{}
+
+// Returned if rendering requires facts not gathered yet.
+var errFactsRequired = errors.New("facts required")
+
+// renderTemplate renders the template into a package. If the facts of the
+// target are used, but not gathered yet, rendering is aborted and repeated
+// after gathering them, so that probing one target doesn't block rendering
+// for all other builds.
+func renderTemplate(builder Template, facts *targetFacts) (*packageImpl, error) {
+	for {
+		p, e := renderTemplateOnce(builder, facts)
+		if e != errFactsRequired {
+			return p, e
+		}
+		facts.gather()
+	}
+}
+
+func renderTemplateOnce(builder Template, facts *targetFacts) (p *packageImpl, e error) {
+	renderMutex.Lock()
+	defer renderMutex.Unlock()
+	facts.setRendering(true)
+	defer facts.setRendering(false)
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(factsError)
+			if !ok {
+				panic(r)
+			}
+			p, e = nil, fe.err
+			if e == nil {
+				e = errFactsRequired
+			}
+		}
+	}()
+
+	builder = withFacts(builder, facts)
+	p = &packageImpl{reference: builder, facts: facts, secrets: newSecretRegistry(secrets)}
+	e = validateTemplate(builder)
 	if e != nil {
 		return nil, e
 	}
 	builder.Render(p)
+	if e = p.expandHandlers(); e != nil {
+		return nil, e
+	}
+	if e = p.resolveDependencies(); e != nil {
+		return nil, e
+	}
 	return p, nil
 }
 
+// commandChecksum returns the checksum identifying the command in the cache,
+// without taking a build's environment or the command's input into account.
 func commandChecksum(c cmd.Command) (string, error) {
-	if c, ok := c.(interface {
-		Checksum() string
-	}); ok {
-		return c.Checksum(), nil
+	return checksumWith(c, nil, nil)
+}
+
+// checksumWith returns the checksum of the command with the given environment
+// and input (nil if the command doesn't consume stdin). The base is the
+// command's own checksum (see cmd.Checksummer) or the hash of its shell code.
+// Environment and input are only mixed in if present, so that checksums of
+// commands without stay the same.
+func checksumWith(c cmd.Command, env []string, input []byte) (string, error) {
+	base := ""
+	if cs, ok := c.(cmd.Checksummer); ok {
+		base = cs.Checksum()
+	} else {
+		base = fmt.Sprintf("%x", sha256.Sum256([]byte(c.Shell())))
 	}
+	if len(env) == 0 && input == nil {
+		return base, nil
+	}
+
 	s := sha256.New()
-	if _, e := s.Write([]byte(c.Shell())); e != nil {
+	if _, e := io.WriteString(s, base); e != nil {
 		return "", e
 	}
+	for _, v := range env {
+		if _, e := fmt.Fprintf(s, "\x00env:%s", v); e != nil {
+			return "", e
+		}
+	}
+	if input != nil {
+		if _, e := fmt.Fprintf(s, "\x00stdin:%x", sha256.Sum256(input)); e != nil {
+			return "", e
+		}
+	}
 	return fmt.Sprintf("%x", s.Sum(nil)), nil
 }
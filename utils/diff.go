@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffLine struct {
+	op   byte // One of ' ', '-' and '+'.
+	text string
+	a, b int // Line numbers (0 based) in the from and to texts.
+}
+
+// Create a unified diff (with three lines of context) of the two given texts.
+// The names are used in the diff's header. An empty string is returned if the
+// texts are equal.
+func Diff(from, to, fromName, toName string) string {
+	if from == to {
+		return ""
+	}
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(lines); {
+		// Find next change.
+		for start < len(lines) && lines[start].op == ' ' {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Extend the hunk until there are more than two times the context
+		// lines without change.
+		end, unchanged := start, 0
+		for i := start; i < len(lines) && unchanged <= 2*diffContext; i++ {
+			if lines[i].op == ' ' {
+				unchanged++
+			} else {
+				unchanged, end = 0, i
+			}
+		}
+
+		first, last := start-diffContext, end+diffContext
+		if first < 0 {
+			first = 0
+		}
+		if last > len(lines)-1 {
+			last = len(lines) - 1
+		}
+		writeHunk(buf, lines[first:last+1])
+		start = last + 1
+	}
+	return buf.String()
+}
+
+func writeHunk(buf *bytes.Buffer, lines []diffLine) {
+	aStart, bStart := lines[0].a, lines[0].b
+	aLen, bLen := 0, 0
+	for _, l := range lines {
+		if l.op != '+' {
+			aLen++
+		}
+		if l.op != '-' {
+			bLen++
+		}
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, l := range lines {
+		fmt.Fprintf(buf, "%c%s\n", l.op, l.text)
+	}
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes the longest common subsequence of the given lines and
+// returns the list of operations required to transform a into b.
+func diffLines(a, b []string) []diffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []diffLine{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{op: ' ', text: a[i], a: i, b: j})
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{op: '-', text: a[i], a: i, b: j})
+			i++
+		default:
+			lines = append(lines, diffLine{op: '+', text: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestDiffEqual(t *testing.T) {
+	if d := Diff("a\nb\n", "a\nb\n", "a", "b"); d != "" {
+		t.Errorf("expected empty diff, got %q", d)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	to := "1\n2\n3\n4\n5\nsix\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+	expected := `--- old
++++ new
+@@ -3,7 +3,7 @@
+ 3
+ 4
+ 5
+-6
++six
+ 7
+ 8
+ 9
+@@ -13,3 +13,4 @@
+ 13
+ 14
+ 15
++16
+`
+	if d := Diff(from, to, "old", "new"); d != expected {
+		t.Errorf("expected diff\n%s\ngot\n%s", expected, d)
+	}
+}
+
+func TestDiffFromEmpty(t *testing.T) {
+	expected := "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n"
+	if d := Diff("", "a\nb", "old", "new"); d != expected {
+		t.Errorf("expected diff %q, got %q", expected, d)
+	}
+}